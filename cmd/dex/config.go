@@ -177,6 +177,7 @@ var connectors = map[string]func() ConnectorConfig{
 	"mockCallback": func() ConnectorConfig { return new(mock.CallbackConfig) },
 	"mockPassword": func() ConnectorConfig { return new(mock.PasswordConfig) },
 	"ldap":         func() ConnectorConfig { return new(ldap.Config) },
+	"ldapMulti":    func() ConnectorConfig { return new(ldap.MultiConfig) },
 	"github":       func() ConnectorConfig { return new(github.Config) },
 	"oidc":         func() ConnectorConfig { return new(oidc.Config) },
 }
@@ -0,0 +1,110 @@
+package ldap
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"gopkg.in/ldap.v2"
+
+	"github.com/coreos/dex/connector"
+)
+
+// validateBindOnly checks that a bindOnly config only sets the options
+// bindOnly uses. There's no service account to search with, and no entry
+// to read groups or claims from.
+func validateBindOnly(c *Config) error {
+	if c.UserSearch.BindDNTemplate == "" {
+		return errors.New("ldap: bindOnly requires userSearch.bindDNTemplate")
+	}
+	if c.BindDN != "" || c.BindPW != "" || c.BindPWFile != "" || c.BindPWEnv != "" || c.AnonymousBind ||
+		(c.BindMode != "" && c.BindMode != bindModeSimple) {
+		return errors.New("ldap: bindOnly doesn't use a service account, remove bindDN, bindPW, anonymousBind, and bindMode")
+	}
+	if c.userSearchSet() {
+		return errors.New("ldap: bindOnly doesn't read the user entry, userSearch.bindDNTemplate is the only userSearch field it uses")
+	}
+	if c.groupSearchSet() {
+		return errors.New("ldap: bindOnly doesn't return groups and cannot be combined with groupSearch")
+	}
+	for _, field := range []struct {
+		name string
+		set  bool
+	}{
+		{"persistentConnection", c.PersistentConnection},
+		{"allowIdentityLookup", c.AllowIdentityLookup},
+		{"allowUserListing", c.AllowUserListing},
+		{"allowEntryPreview", c.AllowEntryPreview},
+	} {
+		if field.set {
+			return fmt.Errorf("ldap: %s requires a service account and cannot be combined with bindOnly", field.name)
+		}
+	}
+	return nil
+}
+
+// userSearchSet reports if any userSearch field other than bindDNTemplate is
+// set. Fields added to userSearch must be listed here.
+func (c *Config) userSearchSet() bool {
+	u := c.UserSearch
+	return u.BaseDN != "" || len(u.FallbackBaseDNs) != 0 || u.Filter != "" ||
+		len(u.Username) != 0 || u.FilterTemplate != "" || u.ExcludeFilter != "" ||
+		u.Scope != "" || u.IDAttr != "" || u.EmailAttr != "" || len(u.NameAttr) != 0 ||
+		u.IDHash != "" || u.IDValues != "" || len(u.Transforms) != 0 ||
+		u.NormalizeEmail || u.StrictEmail || u.EmailSelect != "" ||
+		u.OnMultiple != "" || u.OnNotFound != "" || u.LogEntry != "" ||
+		u.ActiveAttr != "" || len(u.ActiveValues) != 0 || len(u.InactiveValues) != 0 || u.InactiveBits != 0 ||
+		u.MFAEnrolledAttr != "" || len(u.MFAEnrolledValues) != 0 ||
+		u.LocaleAttr != "" || u.ZoneinfoAttr != "" || len(u.HighRiskBaseDNs) != 0 ||
+		u.ExposeDN || len(u.ExposeAttributes) != 0 || u.ChangeMarkerAttr != "" ||
+		u.SizeLimit != 0 || u.TimeLimit != 0 || u.GetAllAttributes || u.ReadEntryAsUser
+}
+
+// bindOnlyIdentity returns the identity of a user authenticated by bindOnly.
+// The user ID is the bound DN, normalized so that usernames differing only in
+// case, which the server binds as the same entry, get the same ID. The
+// username is kept as entered.
+func (c *ldapConnector) bindOnlyIdentity(s connector.Scopes, username, dn string) (connector.Identity, error) {
+	id, err := normalizeDN(dn)
+	if err != nil {
+		return connector.Identity{}, err
+	}
+	ident := connector.Identity{
+		UserID:   c.qualifyUserID(id),
+		Username: username,
+	}
+	if s.OfflineAccess {
+		data := ConnectorData{
+			Username:  username,
+			Entry:     ldap.Entry{DN: dn},
+			Directory: c.directory,
+		}
+		if ident.ConnectorData, err = json.Marshal(data); err != nil {
+			return connector.Identity{}, fmt.Errorf("ldap: marshal entry: %v", err)
+		}
+	}
+	return ident, nil
+}
+
+// normalizeDN returns dn in a canonical form, with attribute types and values
+// lowercased and no spaces around separators, as directories usually match
+// them case insensitively.
+func normalizeDN(dn string) (string, error) {
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil {
+		return "", fmt.Errorf("ldap: parse dn %q: %v", dn, err)
+	}
+	rdns := make([]string, len(parsed.RDNs))
+	for i, rdn := range parsed.RDNs {
+		attrs := make([]string, len(rdn.Attributes))
+		for j, attr := range rdn.Attributes {
+			attrs[j] = strings.ToLower(attr.Type) + "=" + escapeDN(strings.ToLower(attr.Value))
+		}
+		// The attributes of a multi-valued RDN are unordered.
+		sort.Strings(attrs)
+		rdns[i] = strings.Join(attrs, "+")
+	}
+	return strings.Join(rdns, ","), nil
+}
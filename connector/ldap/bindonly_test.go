@@ -0,0 +1,139 @@
+package ldap
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+	"gopkg.in/asn1-ber.v1"
+	"gopkg.in/ldap.v2"
+
+	"github.com/coreos/dex/connector"
+)
+
+func TestBindOnly(t *testing.T) {
+	var searches int
+	addr, stop := fakeServerBinds(t, func(dn, password string) *ber.Packet {
+		// Like most directories, match the DN case insensitively.
+		if strings.EqualFold(dn, "uid=jane,ou=people,dc=example,dc=com") && password == "secret" {
+			return fakeResult(ldap.ApplicationBindResponse, ldap.LDAPResultSuccess)
+		}
+		return fakeResult(ldap.ApplicationBindResponse, ldap.LDAPResultInvalidCredentials)
+	}, func(boundDN string, req *ber.Packet, controls []ldap.Control) []fakeResponse {
+		searches++
+		return nil
+	})
+	defer stop()
+
+	c := new(Config)
+	c.Host = addr
+	c.InsecureNoSSL = true
+	c.BindOnly = true
+	c.UserSearch.BindDNTemplate = "uid={{.Username}},ou=people,dc=example,dc=com"
+	conn, err := c.OpenConnector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lc := conn.(*ldapConnector)
+
+	ident, valid, err := lc.Login(context.Background(), connector.Scopes{OfflineAccess: true}, "jane", "secret")
+	if err != nil || !valid {
+		t.Fatalf("expected valid login, got valid=%t err=%v", valid, err)
+	}
+	if ident.UserID != "uid=jane,ou=people,dc=example,dc=com" || ident.Username != "jane" || ident.Email != "" || len(ident.Groups) != 0 {
+		t.Errorf("unexpected identity %+v", ident)
+	}
+	var data ConnectorData
+	if err := json.Unmarshal(ident.ConnectorData, &data); err != nil {
+		t.Fatal(err)
+	}
+	if data.Entry.DN != "uid=jane,ou=people,dc=example,dc=com" {
+		t.Errorf("unexpected connector data entry DN %q", data.Entry.DN)
+	}
+	if searches != 0 {
+		t.Errorf("expected no searches, got %d", searches)
+	}
+
+	refreshed, err := lc.Refresh(context.Background(), connector.Scopes{OfflineAccess: true}, ident)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refreshed.UserID != ident.UserID {
+		t.Errorf("unexpected refreshed identity %+v", refreshed)
+	}
+
+	// The same entry gets the same user ID whatever the case of the username.
+	other, valid, err := lc.Login(context.Background(), connector.Scopes{}, "Jane", "secret")
+	if err != nil || !valid {
+		t.Fatalf("expected valid login, got valid=%t err=%v", valid, err)
+	}
+	if other.UserID != ident.UserID || other.Username != "Jane" {
+		t.Errorf("unexpected identity %+v", other)
+	}
+
+	if _, valid, err := lc.Login(context.Background(), connector.Scopes{}, "jane", "wrong"); err != nil || valid {
+		t.Errorf("expected invalid password, got valid=%t err=%v", valid, err)
+	}
+}
+
+func TestBindOnlyInvalidConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(c *Config)
+		field  string
+	}{
+		{"no bind dn template", func(c *Config) { c.UserSearch.BindDNTemplate = "" }, "bindDNTemplate"},
+		{"service account", func(c *Config) { c.BindDN = "cn=admin,dc=example,dc=com" }, "service account"},
+		{"anonymous bind", func(c *Config) { c.AnonymousBind = true }, "service account"},
+		{"id attr", func(c *Config) { c.UserSearch.IDAttr = "uid" }, "userSearch"},
+		{"name attr", func(c *Config) { c.UserSearch.NameAttr = StringList{"cn"} }, "userSearch"},
+		{"group search", func(c *Config) { c.GroupSearch.BaseDN = "ou=groups,dc=example,dc=com" }, "groupSearch"},
+		{"user listing", func(c *Config) { c.AllowUserListing = true }, "allowUserListing"},
+	}
+	for _, tc := range tests {
+		c := new(Config)
+		c.Host = "ldap.example.com"
+		c.BindOnly = true
+		c.UserSearch.BindDNTemplate = "uid={{.Username}},ou=people,dc=example,dc=com"
+		tc.modify(c)
+		_, err := c.OpenConnector()
+		if err == nil {
+			t.Errorf("%s: expected error", tc.name)
+			continue
+		}
+		if !strings.Contains(err.Error(), tc.field) {
+			t.Errorf("%s: expected error to mention %q, got %q", tc.name, tc.field, err)
+		}
+	}
+}
+
+func TestBindOnlyEmptyLists(t *testing.T) {
+	c := new(Config)
+	c.Host = "ldap.example.com"
+	c.BindOnly = true
+	c.UserSearch.BindDNTemplate = "uid={{.Username}},ou=people,dc=example,dc=com"
+	// Lists and maps set explicitly empty in the YAML config.
+	c.UserSearch.NameAttr = StringList{}
+	c.UserSearch.ExposeAttributes = []string{}
+	c.GroupSearch.RequiredGroups = []string{}
+	c.GroupSearch.RoleMapping = map[string]string{}
+	if _, err := c.OpenConnector(); err != nil {
+		t.Errorf("expected empty lists to be accepted, got %v", err)
+	}
+}
+
+func TestUserSearchSet(t *testing.T) {
+	// Every field other than bindDNTemplate must be listed, or bindOnly
+	// accepts options it ignores.
+	fields := reflect.TypeOf(Config{}.UserSearch)
+	for i := 0; i < fields.NumField(); i++ {
+		name := fields.Field(i).Name
+		c := new(Config)
+		setNonZero(t, reflect.ValueOf(&c.UserSearch).Elem().Field(i))
+		if set := c.userSearchSet(); set != (name != "BindDNTemplate") {
+			t.Errorf("userSearchSet returns %t for userSearch field %s", set, name)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package ldap
+
+import (
+	"sync"
+	"time"
+)
+
+// circuitBreaker fails connection attempts fast while the directory is down.
+// After threshold consecutive connection failures it opens for the cooldown,
+// then lets a single attempt through to probe whether the directory is back.
+// The probe closes the breaker if it succeeds and reopens it if it fails.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown, now: time.Now}
+}
+
+// allow reports if a connection may be attempted, and if the attempt is the
+// probe let through after the cooldown. Every allowed attempt must be followed
+// by a call to record with the probe result of allow.
+func (b *circuitBreaker) allow() (ok, probe bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failures < b.threshold {
+		return true, false
+	}
+	if b.probing || b.now().Before(b.openUntil) {
+		return false, false
+	}
+	b.probing = true
+	return true, true
+}
+
+// record reports the result of an attempt. Only connection failures count
+// towards opening the breaker; any other result, including a rejected bind,
+// shows the directory is reachable.
+func (b *circuitBreaker) record(probe bool, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// Attempts allowed before the breaker opened may finish while the probe
+	// runs, and must not let a second probe through.
+	if probe {
+		b.probing = false
+	}
+	if err == nil || !isNetworkError(err) {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= b.threshold {
+		b.openUntil = b.now().Add(b.cooldown)
+	}
+}
@@ -0,0 +1,106 @@
+package ldap
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"gopkg.in/ldap.v2"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	b := newCircuitBreaker(2, time.Minute)
+	b.now = func() time.Time { return now }
+
+	networkErr := ldap.NewError(ldap.ErrorNetwork, errors.New("connection refused"))
+	authErr := ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("invalid credentials"))
+
+	// Rejected binds show the directory is up and don't count.
+	for i := 0; i < 3; i++ {
+		if ok, probe := b.allow(); !ok || probe {
+			t.Fatalf("expected attempt %d to be allowed, got ok=%t probe=%t", i, ok, probe)
+		}
+		b.record(false, authErr)
+	}
+
+	// An attempt that starts before the breaker opens.
+	if ok, _ := b.allow(); !ok {
+		t.Fatal("expected attempt to be allowed")
+	}
+	for i := 0; i < 2; i++ {
+		if ok, _ := b.allow(); !ok {
+			t.Fatalf("expected attempt %d to be allowed", i)
+		}
+		b.record(false, networkErr)
+	}
+	if ok, _ := b.allow(); ok {
+		t.Errorf("expected breaker to open after consecutive connection failures")
+	}
+
+	// After the cooldown a single probe is let through.
+	now = now.Add(time.Minute)
+	if ok, probe := b.allow(); !ok || !probe {
+		t.Fatalf("expected a probe after the cooldown, got ok=%t probe=%t", ok, probe)
+	}
+	if ok, _ := b.allow(); ok {
+		t.Errorf("expected only one probe at a time")
+	}
+	// The earlier attempt finishing doesn't end the probe.
+	b.record(false, networkErr)
+	if ok, _ := b.allow(); ok {
+		t.Errorf("expected no second probe while the first runs")
+	}
+	b.record(true, networkErr)
+	if ok, _ := b.allow(); ok {
+		t.Errorf("expected a failed probe to reopen the breaker")
+	}
+
+	now = now.Add(time.Minute)
+	ok, probe := b.allow()
+	if !ok || !probe {
+		t.Fatalf("expected a probe after the cooldown, got ok=%t probe=%t", ok, probe)
+	}
+	b.record(probe, nil)
+	for i := 0; i < 2; i++ {
+		if ok, probe := b.allow(); !ok || probe {
+			t.Errorf("expected a successful probe to close the breaker, got ok=%t probe=%t", ok, probe)
+		}
+	}
+}
+
+func TestConnectCircuitOpen(t *testing.T) {
+	// A port that nothing listens on.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	c := testConfig()
+	c.Host = addr
+	c.InsecureNoSSL = true
+	c.BreakerThreshold = 1
+	c.BreakerCooldown = "1h"
+	conn, err := c.OpenConnector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lc := conn.(*ldapConnector)
+
+	if _, err := lc.connectAny(context.Background(), true); errors.Is(err, ErrCircuitOpen) || !errors.Is(err, ErrDial) {
+		t.Fatalf("expected first attempt to dial, got %v", err)
+	}
+	_, err = lc.connectAny(context.Background(), true)
+	if !errors.Is(err, ErrCircuitOpen) || !errors.Is(err, ErrDial) {
+		t.Errorf("expected second attempt to fail fast, got %v", err)
+	}
+
+	c.BreakerThreshold = 0
+	if _, err := c.OpenConnector(); err == nil {
+		t.Errorf("expected error for breakerCooldown without breakerThreshold")
+	}
+}
@@ -0,0 +1,82 @@
+package ldap
+
+import (
+	"sync"
+	"time"
+)
+
+// groupCache is a size bounded cache of group search results keyed by user
+// DN. Entries expire after a fixed TTL.
+type groupCache struct {
+	ttl     time.Duration
+	maxSize int
+	now     func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]groupCacheEntry
+}
+
+type groupCacheEntry struct {
+	groups []Group
+	expiry time.Time
+}
+
+func newGroupCache(ttl time.Duration, maxSize int) *groupCache {
+	return &groupCache{
+		ttl:     ttl,
+		maxSize: maxSize,
+		now:     time.Now,
+		entries: make(map[string]groupCacheEntry),
+	}
+}
+
+// get returns the cached groups for a user DN, if present and not expired.
+func (g *groupCache) get(dn string) ([]Group, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	e, ok := g.entries[dn]
+	if !ok {
+		return nil, false
+	}
+	if !g.now().Before(e.expiry) {
+		delete(g.entries, dn)
+		return nil, false
+	}
+	return e.groups, true
+}
+
+// set caches groups for a user DN. If the cache is full, expired entries are
+// removed, then the entry closest to expiring.
+func (g *groupCache) set(dn string, groups []Group) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := g.now()
+	if _, ok := g.entries[dn]; !ok && len(g.entries) >= g.maxSize {
+		var (
+			oldestDN     string
+			oldestExpiry time.Time
+		)
+		for k, e := range g.entries {
+			if !now.Before(e.expiry) {
+				delete(g.entries, k)
+				continue
+			}
+			if oldestDN == "" || e.expiry.Before(oldestExpiry) {
+				oldestDN, oldestExpiry = k, e.expiry
+			}
+		}
+		if len(g.entries) >= g.maxSize {
+			delete(g.entries, oldestDN)
+		}
+	}
+	g.entries[dn] = groupCacheEntry{groups: groups, expiry: now.Add(g.ttl)}
+}
+
+// clear removes all entries from the cache.
+func (g *groupCache) clear() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.entries = make(map[string]groupCacheEntry)
+}
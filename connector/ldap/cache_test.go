@@ -0,0 +1,44 @@
+package ldap
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestGroupCache(t *testing.T) {
+	now := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := newGroupCache(time.Minute, 2)
+	c.now = func() time.Time { return now }
+
+	c.set("uid=a", []Group{{Name: "admins"}})
+	if got, ok := c.get("uid=a"); !ok || !reflect.DeepEqual(got, []Group{{Name: "admins"}}) {
+		t.Errorf("expected cached groups, got %q (ok=%t)", got, ok)
+	}
+
+	// Adding entries beyond the max size evicts the entry closest to expiring.
+	now = now.Add(time.Second)
+	c.set("uid=b", []Group{{Name: "developers"}})
+	now = now.Add(time.Second)
+	c.set("uid=c", []Group{{Name: "ops"}})
+	if _, ok := c.get("uid=a"); ok {
+		t.Errorf("expected oldest entry to be evicted")
+	}
+	if _, ok := c.get("uid=b"); !ok {
+		t.Errorf("expected entry to still be cached")
+	}
+
+	// Entries expire after the TTL.
+	now = now.Add(59 * time.Second)
+	if _, ok := c.get("uid=b"); ok {
+		t.Errorf("expected entry to expire")
+	}
+	if _, ok := c.get("uid=c"); !ok {
+		t.Errorf("expected entry to still be cached")
+	}
+
+	c.clear()
+	if _, ok := c.get("uid=c"); ok {
+		t.Errorf("expected cleared cache to be empty")
+	}
+}
@@ -0,0 +1,282 @@
+package ldap
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/net/context"
+	"gopkg.in/ldap.v2"
+
+	"github.com/coreos/dex/connector"
+)
+
+// LoginDiagnostics describes each step of a test login, for debugging a
+// connector's configuration.
+type LoginDiagnostics struct {
+	// The filter used to search for the user. Empty with
+	// userSearch.bindDNTemplate, which builds the DN without a search.
+	UserFilter string
+	// The DN of the user entry the search found, or built from
+	// userSearch.bindDNTemplate.
+	UserDN string
+	// The attributes read from the user entry.
+	Attributes map[string][]string
+
+	// The base DN and filter used to search for the user's groups. Empty if
+	// group search isn't configured.
+	GroupBaseDN string
+	GroupFilter string
+	// The groups resolved for the user.
+	Groups []string
+
+	// The identity that would be returned by a login.
+	Identity connector.Identity
+}
+
+// TestLogin runs the same user search, bind, and group search as a login,
+// returning details of each step. It's intended for debugging a configuration
+// without running the dex server.
+//
+// If a step fails, the returned diagnostics are filled in up to the point of
+// the failure.
+func (c *Config) TestLogin(ctx context.Context, username, password string) (*LoginDiagnostics, error) {
+	conn, err := c.OpenConnector()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.(*ldapConnector).testLogin(ctx, username, password)
+}
+
+func (c *ldapConnector) testLogin(ctx context.Context, username, password string) (*LoginDiagnostics, error) {
+	d := new(LoginDiagnostics)
+	if password == "" {
+		// Logins reject empty passwords rather than attempt an unauthenticated
+		// bind, which many servers accept.
+		return d, errors.New("ldap: empty password, logins reject it without binding")
+	}
+
+	var user ldap.Entry
+	// resolve fills in the rest of the diagnostics from the user entry. With
+	// groupSearch.asUser it runs over the connection bound as the user, as in
+	// logins.
+	resolve := func(ctx context.Context) error {
+		d.UserDN = user.DN
+		d.Attributes = entryAttributes(user)
+		return c.testIdentity(ctx, d, user)
+	}
+	// bound checks the bind as the user, and reads their entry over the
+	// connection if read is set.
+	bound := func(dn string, read bool) func(conn *ldap.Conn, err error) error {
+		return func(conn *ldap.Conn, err error) error {
+			if err != nil {
+				return fmt.Errorf("ldap: failed to bind as dn %q: %w", dn, err)
+			}
+			if read {
+				entry, found, err := c.readUserEntry(ctx, conn, dn)
+				if err != nil {
+					return err
+				}
+				if !found {
+					return fmt.Errorf("ldap: user %q bound but can't read their entry", dn)
+				}
+				user = entry
+			}
+			if c.GroupSearch.AsUser {
+				return resolve(withUserConn(ctx, conn))
+			}
+			return nil
+		}
+	}
+
+	if c.userBindDN != nil {
+		dn, err := c.userBindDNFor(username)
+		if err != nil {
+			return d, err
+		}
+		d.UserDN = dn
+		if err := c.bindAsUser(ctx, dn, password, bound(dn, !c.BindOnly)); err != nil {
+			return d, err
+		}
+		if c.BindOnly {
+			d.Identity, err = c.bindOnlyIdentity(connector.Scopes{}, username, dn)
+			return d, err
+		}
+	} else {
+		filter, err := c.userSearchFilter(username)
+		if err != nil {
+			return d, err
+		}
+		d.UserFilter = filter
+
+		err = c.doRead(ctx, func(conn *ldap.Conn) error {
+			entry, found, err := c.userEntry(ctx, conn, username)
+			if err != nil {
+				return err
+			}
+			if !found {
+				return fmt.Errorf("%w: user search returned no usable entry", ErrUserNotFound)
+			}
+			user = entry
+			return nil
+		})
+		if err != nil {
+			return d, err
+		}
+		d.UserDN = user.DN
+
+		if c.BindMode == bindModeNTLM {
+			account := getAttr(user, "sAMAccountName")
+			if account == "" {
+				return d, fmt.Errorf("ldap: user %q has no sAMAccountName to bind with NTLM", user.DN)
+			}
+			conn, err := c.connectNTLM(ctx, account, password)
+			if err != nil {
+				return d, fmt.Errorf("ldap: NTLM bind as %q failed: %w", account, err)
+			}
+			err = bound(user.DN, c.UserSearch.ReadEntryAsUser)(conn, nil)
+			conn.Close()
+			if err != nil {
+				return d, err
+			}
+		} else if err := c.bindAsUser(ctx, user.DN, password, bound(user.DN, c.UserSearch.ReadEntryAsUser)); err != nil {
+			return d, err
+		}
+	}
+
+	if c.GroupSearch.AsUser {
+		return d, nil
+	}
+	return d, resolve(ctx)
+}
+
+// testIdentity fills in the identity and groups a login would return for
+// the user.
+func (c *ldapConnector) testIdentity(ctx context.Context, d *LoginDiagnostics, user ldap.Entry) error {
+	var err error
+	if d.Identity, err = c.identityFromEntry(user); err != nil {
+		return err
+	}
+	if !c.groupsConfigured() {
+		return nil
+	}
+	if c.GroupSearch.BaseDN != "" {
+		if d.GroupBaseDN, err = c.groupSearchBaseDN(user); err != nil {
+			return err
+		}
+		d.GroupFilter = c.groupSearchFilter(user)
+	}
+	if d.Groups, err = c.groups(ctx, user); err != nil {
+		return err
+	}
+	d.Identity.Groups = c.groupClaims(ctx, user.DN, d.Groups)
+	return nil
+}
+
+// GroupDiagnostics describes a group search for a user, for debugging the
+// groupSearch configuration separately from logins.
+type GroupDiagnostics struct {
+	// The DN of the user entry the groups were searched for.
+	UserDN string
+
+	// The base DN and filter used to search for the user's groups.
+	GroupBaseDN string
+	GroupFilter string
+	// The group entries matched by the search.
+	Matches []GroupMatch
+	// The user's primary group, if groupSearch.primaryGroup is set.
+	PrimaryGroups []Group
+
+	// The names of the user's groups and the resulting groups claim.
+	Groups []string
+	Claims []string
+}
+
+// GroupMatch is a group entry matched by the group search.
+type GroupMatch struct {
+	DN string
+	// The groups the entry resolved to, more than one if its name attribute has
+	// several values.
+	Groups []Group
+}
+
+// TestGroups runs only the group search for a user, returning the filter used
+// and the groups it matched. The user is looked up as for an identity lookup,
+// so no password is needed. The groups cache isn't used.
+//
+// If a step fails, the returned diagnostics are filled in up to the point of
+// the failure.
+func (c *Config) TestGroups(ctx context.Context, username string) (*GroupDiagnostics, error) {
+	conn, err := c.OpenConnector()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.(*ldapConnector).testGroups(ctx, username)
+}
+
+func (c *ldapConnector) testGroups(ctx context.Context, username string) (*GroupDiagnostics, error) {
+	d := new(GroupDiagnostics)
+	if !c.groupsConfigured() {
+		return d, errors.New("ldap: groupSearch is not configured")
+	}
+
+	var user ldap.Entry
+	err := c.doRead(ctx, func(conn *ldap.Conn) error {
+		entry, found, err := c.findUser(ctx, conn, username)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return fmt.Errorf("%w: %q", ErrUserNotFound, username)
+		}
+		user = entry
+		return nil
+	})
+	if err != nil {
+		return d, err
+	}
+	d.UserDN = user.DN
+
+	if c.GroupSearch.UserGroupsAttr == "" {
+		req, _, err := c.groupSearchRequest(user)
+		if err != nil {
+			return d, err
+		}
+		d.GroupBaseDN = req.BaseDN
+		d.GroupFilter = req.Filter
+		if !c.hasGroupMatchValue(user) {
+			return d, fmt.Errorf("ldap: user %q has no value for groupSearch.userAttr %q", user.DN, c.GroupSearch.UserAttr)
+		}
+	}
+
+	var groups []Group
+	err = c.eachGroupMatch(ctx, user, func(matches []GroupMatch) error {
+		for _, m := range matches {
+			switch {
+			case m.DN != "":
+				d.Matches = append(d.Matches, m)
+			case c.GroupSearch.UserGroupsAttr == "":
+				d.PrimaryGroups = append(d.PrimaryGroups, m.Groups...)
+			}
+			groups = append(groups, m.Groups...)
+		}
+		return nil
+	})
+	if err != nil {
+		return d, err
+	}
+
+	d.Groups = groupNamesOf(groups)
+	d.Claims = c.groupClaims(ctx, user.DN, d.Groups)
+	return d, nil
+}
+
+// entryAttributes returns the attributes of an entry as a map.
+func entryAttributes(e ldap.Entry) map[string][]string {
+	attrs := make(map[string][]string, len(e.Attributes))
+	for _, a := range e.Attributes {
+		attrs[a.Name] = append(attrs[a.Name], a.Values...)
+	}
+	return attrs
+}
@@ -0,0 +1,225 @@
+package ldap
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/proxy"
+	"gopkg.in/asn1-ber.v1"
+	"gopkg.in/ldap.v2"
+)
+
+// DialFunc opens a network connection to addr. network is "tcp", or "unix"
+// for ldapi hosts. The connection is returned before any TLS handshake, which
+// the connector performs itself.
+type DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// WithDialFunc configures the connector to open network connections with f
+// instead of dialing them directly, for example to connect to an in-memory
+// server in tests or over an unusual transport. Connections to a proxyURL are
+// opened with f too, and sourceAddress and keepAlive are left to f.
+func WithDialFunc(f DialFunc) Option {
+	return func(c *ldapConnector) { c.dialFunc = f }
+}
+
+// dialConn opens a network connection to the endpoint, through the configured
+// proxy if any, and performs a TLS handshake if requested, after the StartTLS
+// operation if the endpoint uses it. Errors are returned as ldap.ErrorNetwork
+// errors, except the server refusing StartTLS.
+func (c *ldapConnector) dialConn(ctx context.Context, e endpoint) (net.Conn, error) {
+	var (
+		conn net.Conn
+		err  error
+	)
+	dial := c.dialFunc
+	if dial == nil {
+		dialer := &net.Dialer{Timeout: ldap.DefaultTimeout, KeepAlive: c.keepAlive}
+		if c.localAddr != nil {
+			dialer.LocalAddr = c.localAddr
+		}
+		dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, addr)
+		}
+	}
+	d := &contextDialer{ctx: ctx, dial: dial}
+	switch {
+	case c.proxyURL == nil || e.network == "unix":
+		conn, err = d.Dial(e.network, e.addr)
+	case c.proxyURL.Scheme == "socks5":
+		conn, err = dialSOCKS5(d, c.proxyURL, e.addr)
+	default:
+		conn, err = dialHTTPConnect(d, c.proxyURL, e.addr)
+	}
+	if err != nil {
+		return nil, ldap.NewError(ldap.ErrorNetwork, err)
+	}
+	if err := c.setSocketOptions(conn); err != nil {
+		conn.Close()
+		return nil, ldap.NewError(ldap.ErrorNetwork, err)
+	}
+	if !e.useTLS {
+		return conn, nil
+	}
+	if e.startTLS {
+		if err := startTLS(conn); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	// The handshake verifies the server's certificate against the endpoint's
+	// configuration whether or not StartTLS was used.
+	tlsConn := tls.Client(conn, e.tlsConfig)
+	if err := handshake(ctx, tlsConn); err != nil {
+		conn.Close()
+		return nil, ldap.NewError(ldap.ErrorNetwork, err)
+	}
+	return tlsConn, nil
+}
+
+// handshake performs the TLS handshake, giving up and closing the connection
+// if ctx is done first.
+func handshake(ctx context.Context, conn *tls.Conn) error {
+	errc := make(chan error, 1)
+	go func() { errc <- conn.Handshake() }()
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+		conn.Close()
+		<-errc
+		return ctx.Err()
+	}
+}
+
+// setSocketOptions applies tcpNoDelay, readBufferSize, and writeBufferSize
+// to a TCP connection. Options left unset, and connections of other types,
+// such as those returned by a DialFunc for tests, are left as they are.
+func (c *ldapConnector) setSocketOptions(conn net.Conn) error {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	if c.TCPNoDelay != "" {
+		if err := tcpConn.SetNoDelay(c.TCPNoDelay == tcpNoDelayOn); err != nil {
+			return fmt.Errorf("set tcpNoDelay: %v", err)
+		}
+	}
+	if c.ReadBufferSize != 0 {
+		if err := tcpConn.SetReadBuffer(c.ReadBufferSize); err != nil {
+			return fmt.Errorf("set readBufferSize: %v", err)
+		}
+	}
+	if c.WriteBufferSize != 0 {
+		if err := tcpConn.SetWriteBuffer(c.WriteBufferSize); err != nil {
+			return fmt.Errorf("set writeBufferSize: %v", err)
+		}
+	}
+	return nil
+}
+
+// contextDialer implements proxy.Dialer, dialing with a context.
+type contextDialer struct {
+	ctx  context.Context
+	dial DialFunc
+}
+
+func (d *contextDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.dial(d.ctx, network, addr)
+}
+
+func dialSOCKS5(d proxy.Dialer, proxyURL *url.URL, host string) (net.Conn, error) {
+	var auth *proxy.Auth
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		auth = &proxy.Auth{User: proxyURL.User.Username(), Password: password}
+	}
+	socks, err := proxy.SOCKS5("tcp", proxyURL.Host, auth, d)
+	if err != nil {
+		return nil, fmt.Errorf("socks5 proxy: %v", err)
+	}
+	conn, err := socks.Dial("tcp", host)
+	if err != nil {
+		return nil, fmt.Errorf("socks5 proxy: %v", err)
+	}
+	return conn, nil
+}
+
+// dialHTTPConnect opens a tunnel to host through an HTTP proxy using the
+// CONNECT method.
+func dialHTTPConnect(d proxy.Dialer, proxyURL *url.URL, host string) (net.Conn, error) {
+	conn, err := d.Dial("tcp", proxyURL.Host)
+	if err != nil {
+		return nil, fmt.Errorf("http proxy: %v", err)
+	}
+
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: host},
+		Host:   host,
+		Header: make(http.Header),
+	}
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		creds := base64.StdEncoding.EncodeToString([]byte(proxyURL.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+creds)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("http proxy: write CONNECT request: %v", err)
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("http proxy: read CONNECT response: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("http proxy: CONNECT to %s failed: %s", host, resp.Status)
+	}
+	if br.Buffered() == 0 {
+		return conn, nil
+	}
+	// Don't lose any data the proxy sent after the response.
+	return &bufferedConn{Conn: conn, r: br}, nil
+}
+
+// bufferedConn is a net.Conn which reads through a buffered reader.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// startTLSOID is the name of the StartTLS extended operation.
+const startTLSOID = "1.3.6.1.4.1.1466.20037"
+
+// startTLS asks the server to start TLS on conn. Like SASL binds, the
+// operation is written directly to the connection, so the TLS handshake can
+// follow before the connection is handed off to the ldap library.
+func startTLS(conn net.Conn) error {
+	req := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationExtendedRequest, nil, "Start TLS")
+	req.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 0, startTLSOID, "TLS Extended Command"))
+	resp, err := rawRequest(conn, req)
+	if err != nil {
+		return err
+	}
+	if tag := resp.Children[1].Tag; tag != ldap.ApplicationExtendedResponse {
+		return ldap.NewError(ldap.ErrorUnexpectedResponse, fmt.Errorf("ldap: expected extended response got tag %d", tag))
+	}
+	if err := rawResultCode(resp); err != nil {
+		return fmt.Errorf("ldap: server refused StartTLS: %w", err)
+	}
+	return nil
+}
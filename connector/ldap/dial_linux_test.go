@@ -0,0 +1,65 @@
+//go:build linux
+// +build linux
+
+package ldap
+
+import (
+	"net"
+	"syscall"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestSocketOptions(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	c := testConfig()
+	c.Host = l.Addr().String()
+	c.InsecureNoSSL = true
+	c.TCPNoDelay = "off"
+	c.ReadBufferSize = 64 << 10
+	c.WriteBufferSize = 128 << 10
+	conn, err := c.OpenConnector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lc := conn.(*ldapConnector)
+	netConn, err := lc.dialConn(context.Background(), lc.endpoints[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer netConn.Close()
+
+	f, err := netConn.(*net.TCPConn).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fd := int(f.Fd())
+
+	if noDelay, err := syscall.GetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_NODELAY); err != nil || noDelay != 0 {
+		t.Errorf("expected TCP_NODELAY to be cleared, got %d, err=%v", noDelay, err)
+	}
+	// Linux doubles the requested sizes to allow for bookkeeping overhead,
+	// see socket(7).
+	if size, err := syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_RCVBUF); err != nil || size < c.ReadBufferSize {
+		t.Errorf("expected SO_RCVBUF of at least %d, got %d, err=%v", c.ReadBufferSize, size, err)
+	}
+	if size, err := syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_SNDBUF); err != nil || size < c.WriteBufferSize {
+		t.Errorf("expected SO_SNDBUF of at least %d, got %d, err=%v", c.WriteBufferSize, size, err)
+	}
+}
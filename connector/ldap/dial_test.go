@@ -0,0 +1,222 @@
+package ldap
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"golang.org/x/net/context"
+	"gopkg.in/asn1-ber.v1"
+	"gopkg.in/ldap.v2"
+
+	"github.com/coreos/dex/connector"
+)
+
+func TestDialHTTPConnect(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil {
+			t.Errorf("read request: %v", err)
+			return
+		}
+		if req.Method != "CONNECT" || req.Host != "ldap.example.com:636" {
+			t.Errorf("unexpected request %s %s", req.Method, req.Host)
+		}
+		if req.Header.Get("Proxy-Authorization") != "Basic amFuZTpwYXNz" {
+			t.Errorf("unexpected Proxy-Authorization header %q", req.Header.Get("Proxy-Authorization"))
+		}
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\nok"))
+	}()
+
+	proxyURL := &url.URL{Scheme: "http", Host: l.Addr().String(), User: url.UserPassword("jane", "pass")}
+	conn, err := dialHTTPConnect(&net.Dialer{}, proxyURL, "ldap.example.com:636")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Data sent after the CONNECT response belongs to the tunnel.
+	buf := make([]byte, 2)
+	if _, err := conn.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "ok" {
+		t.Errorf("expected tunneled data %q got %q", "ok", buf)
+	}
+}
+
+func TestProxyURLDefaultPort(t *testing.T) {
+	tests := []struct {
+		proxyURL string
+		wantHost string
+	}{
+		{"http://proxy.example.com", "proxy.example.com:80"},
+		{"socks5://proxy.example.com", "proxy.example.com:1080"},
+		{"http://proxy.example.com:3128", "proxy.example.com:3128"},
+		{"http://[2001:db8::1]", "[2001:db8::1]:80"},
+	}
+	for _, test := range tests {
+		c := testConfig()
+		c.ProxyURL = test.proxyURL
+		conn, err := c.OpenConnector()
+		if err != nil {
+			t.Errorf("%s: %v", test.proxyURL, err)
+			continue
+		}
+		if got := conn.(*ldapConnector).proxyURL.Host; got != test.wantHost {
+			t.Errorf("%s: want host %q, got %q", test.proxyURL, test.wantHost, got)
+		}
+	}
+}
+
+func TestTLSHandshakeCanceled(t *testing.T) {
+	// A server that accepts connections but never answers the handshake.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		accepted <- conn
+	}()
+
+	c := testConfig()
+	c.Host = l.Addr().String()
+	conn, err := c.OpenConnector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lc := conn.(*ldapConnector)
+
+	// The server stays open, so only the cancellation ends the handshake.
+	ctx, cancel := context.WithCancel(context.Background())
+	server := make(chan net.Conn, 1)
+	go func() {
+		conn := <-accepted
+		server <- conn
+		cancel()
+	}()
+	_, err = lc.dialConn(ctx, lc.endpoints[0])
+	(<-server).Close()
+	if err == nil {
+		t.Fatal("expected the handshake to be abandoned")
+	}
+}
+
+func TestSourceAddress(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	remote := make(chan string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		remote <- conn.RemoteAddr().(*net.TCPAddr).IP.String()
+		conn.Close()
+	}()
+
+	c := testConfig()
+	c.Host = l.Addr().String()
+	c.InsecureNoSSL = true
+	// Any address in 127.0.0.0/8 is local on the loopback interface.
+	c.SourceAddress = "127.0.0.2"
+	conn, err := c.OpenConnector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lc := conn.(*ldapConnector)
+	netConn, err := lc.dialConn(context.Background(), lc.endpoints[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	netConn.Close()
+	if got := <-remote; got != "127.0.0.2" {
+		t.Errorf("expected connection from 127.0.0.2, got %s", got)
+	}
+
+	c.SourceAddress = "127.0.0.2:1234"
+	if _, err := c.OpenConnector(); err == nil {
+		t.Errorf("expected error for a sourceAddress with a port")
+	}
+}
+
+func TestDialFunc(t *testing.T) {
+	var dialed []string
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed = append(dialed, network+" "+addr)
+		client, server := net.Pipe()
+		go serveFake(server, func(boundDN string, req *ber.Packet, controls []ldap.Control) []fakeResponse {
+			return []fakeResponse{
+				{op: fakeEntry("uid=jane,ou=people,dc=example,dc=com", map[string][]string{
+					"uid":  {"jane"},
+					"mail": {"jane@example.com"},
+					"cn":   {"Jane Doe"},
+				})},
+				{op: fakeResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)},
+			}
+		})
+		return client, nil
+	}
+
+	c := testConfig()
+	// Never resolved, the dial function is used instead.
+	c.Host = "ldap.invalid:389"
+	c.InsecureNoSSL = true
+	c.UserSearch.IDAttr = "uid"
+	c.UserSearch.EmailAttr = "mail"
+	c.UserSearch.NameAttr = StringList{"cn"}
+	conn, err := c.OpenConnector(WithDialFunc(dial))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ident, valid, err := conn.Login(context.Background(), connector.Scopes{}, "jane", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !valid {
+		t.Fatalf("expected valid password")
+	}
+	if ident.Email != "jane@example.com" {
+		t.Errorf("want email %q, got %q", "jane@example.com", ident.Email)
+	}
+	if len(dialed) == 0 || dialed[0] != "tcp ldap.invalid:389" {
+		t.Errorf("expected dial of %q, got %q", "tcp ldap.invalid:389", dialed)
+	}
+}
+
+func TestSocketOptionsConfig(t *testing.T) {
+	for _, modify := range []func(c *Config){
+		func(c *Config) { c.TCPNoDelay = "yes" },
+		func(c *Config) { c.ReadBufferSize = -1 },
+		func(c *Config) { c.Host = "ldapi:///var/run/slapd/ldapi"; c.WriteBufferSize = 1 << 20 },
+	} {
+		c := testConfig()
+		modify(c)
+		if _, err := c.OpenConnector(); err == nil {
+			t.Errorf("expected error for tcpNoDelay %q, readBufferSize %d, writeBufferSize %d with host %q",
+				c.TCPNoDelay, c.ReadBufferSize, c.WriteBufferSize, c.Host)
+		}
+	}
+}
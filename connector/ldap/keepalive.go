@@ -0,0 +1,53 @@
+package ldap
+
+import (
+	"math/rand"
+	"time"
+
+	"golang.org/x/net/context"
+	"gopkg.in/ldap.v2"
+)
+
+// keepAliveLoop pings the persistent connection until the connector is
+// closed. Each interval is shortened by up to a tenth at random so that
+// several dex instances started together don't ping the server in lockstep.
+func (c *ldapConnector) keepAliveLoop() {
+	for {
+		jitter := time.Duration(rand.Int63n(int64(c.keepAlive/10) + 1))
+		t := time.NewTimer(c.keepAlive - jitter)
+		select {
+		case <-c.stopKeepAlive:
+			t.Stop()
+			return
+		case <-t.C:
+		}
+		c.ping()
+	}
+}
+
+// ping reads the root DSE over the persistent connection, if one is open. A
+// connection that fails the read is discarded so the next request dials a new
+// one rather than failing.
+func (c *ldapConnector) ping() {
+	c.mu.Lock()
+	conn := c.persistentConn
+	if c.closed {
+		conn = nil
+	}
+	c.mu.Unlock()
+	if conn == nil {
+		return
+	}
+
+	req := &ldap.SearchRequest{
+		BaseDN: "",
+		Scope:  ldap.ScopeBaseObject,
+		Filter: "(objectClass=*)",
+		// Request no attributes, see RFC 4511 section 4.5.1.8.
+		Attributes: []string{"1.1"},
+	}
+	if _, err := c.search(context.Background(), conn, req); err != nil {
+		c.logf(context.Background(), "ldap: keepalive failed, dropping persistent connection: %v", err)
+		c.dropPersistentConnection(conn)
+	}
+}
@@ -0,0 +1,201 @@
+package ldap
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/net/context"
+	"gopkg.in/asn1-ber.v1"
+	"gopkg.in/ldap.v2"
+
+	"github.com/coreos/dex/connector"
+)
+
+func TestPingDropsFailedConnection(t *testing.T) {
+	c := testConfig()
+	c.PersistentConnection = true
+	conn, err := c.OpenConnector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	lc := conn.(*ldapConnector)
+
+	// A server that hangs up, like a firewall reaping an idle connection.
+	stale := closedConn()
+	lc.mu.Lock()
+	lc.persistentConn = stale
+	lc.mu.Unlock()
+
+	lc.ping()
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	if lc.persistentConn != nil {
+		t.Errorf("expected failed connection to be dropped")
+	}
+}
+
+func TestKeepAliveValidation(t *testing.T) {
+	for _, keepAlive := range []string{"5", "-1m", "0s"} {
+		c := testConfig()
+		c.KeepAlive = keepAlive
+		if _, err := c.OpenConnector(); err == nil {
+			t.Errorf("%q: expected error", keepAlive)
+		}
+	}
+}
+
+func TestPersistentConnectionRetry(t *testing.T) {
+	var searches int32
+	addr, stop := fakeServer(t, func(req *ber.Packet, controls []ldap.Control) []fakeResponse {
+		atomic.AddInt32(&searches, 1)
+		if baseDN, _ := req.Children[0].Value.(string); baseDN == "ou=big,dc=example,dc=com" {
+			return []fakeResponse{{op: fakeResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSizeLimitExceeded)}}
+		}
+		return []fakeResponse{
+			{op: fakeEntry("uid=jane,ou=people,dc=example,dc=com", map[string][]string{"uid": {"jane"}, "mail": {"jane@example.com"}})},
+			{op: fakeResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)},
+		}
+	})
+	defer stop()
+
+	c := testConfig()
+	c.Host = addr
+	c.InsecureNoSSL = true
+	c.PersistentConnection = true
+	c.UserSearch.IDAttr = "uid"
+	c.UserSearch.EmailAttr = "mail"
+	conn, err := c.OpenConnector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	lc := conn.(*ldapConnector)
+
+	// A connection the server has silently closed.
+	stale := closedConn()
+	lc.mu.Lock()
+	lc.persistentConn = stale
+	lc.mu.Unlock()
+
+	if _, valid, err := conn.Login(context.Background(), connector.Scopes{}, "jane", "password"); err != nil || !valid {
+		t.Fatalf("expected login to succeed on a new connection, got valid=%t err=%v", valid, err)
+	}
+
+	// Errors returned by the server aren't retried.
+	atomic.StoreInt32(&searches, 0)
+	req := &ldap.SearchRequest{BaseDN: "ou=big,dc=example,dc=com", Scope: ldap.ScopeWholeSubtree, Filter: "(objectClass=*)"}
+	err = lc.doRead(context.Background(), func(conn *ldap.Conn) error {
+		_, err := lc.search(context.Background(), conn, req)
+		return err
+	})
+	if !isResultCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		t.Errorf("expected size limit error, got %v", err)
+	}
+	if n := atomic.LoadInt32(&searches); n != 1 {
+		t.Errorf("expected 1 search, got %d", n)
+	}
+
+	// Nor are failures to reach another server over a healthy connection.
+	calls := 0
+	err = lc.doRead(context.Background(), func(conn *ldap.Conn) error {
+		calls++
+		return wrapKind(ErrDial, ldap.NewError(ldap.ErrorNetwork, errors.New("connection refused")), "")
+	})
+	if err == nil || calls != 1 {
+		t.Errorf("expected one failed call, got %d calls and err=%v", calls, err)
+	}
+}
+
+func TestPersistentConnectionShared(t *testing.T) {
+	addr, stop := fakeServer(t, func(req *ber.Packet, controls []ldap.Control) []fakeResponse {
+		return []fakeResponse{{op: fakeResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)}}
+	})
+	defer stop()
+
+	c := testConfig()
+	c.Host = addr
+	c.InsecureNoSSL = true
+	c.PersistentConnection = true
+	conn, err := c.OpenConnector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	lc := conn.(*ldapConnector)
+
+	// A call in progress doesn't block others from using the connection.
+	inside := make(chan *ldap.Conn)
+	release := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- lc.doRead(context.Background(), func(conn *ldap.Conn) error {
+			inside <- conn
+			<-release
+			return nil
+		})
+	}()
+	first := <-inside
+	err = lc.doRead(context.Background(), func(conn *ldap.Conn) error {
+		if conn != first {
+			t.Errorf("expected concurrent calls to share the persistent connection")
+		}
+		return nil
+	})
+	close(release)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// Calls that may not be idempotent aren't retried on a closed connection.
+	stale := closedConn()
+	lc.mu.Lock()
+	lc.persistentConn = stale
+	lc.mu.Unlock()
+
+	calls := 0
+	err = lc.do(context.Background(), func(conn *ldap.Conn) error {
+		calls++
+		_, err := lc.search(context.Background(), conn, &ldap.SearchRequest{Filter: "(objectClass=*)"})
+		return err
+	})
+	if !isStaleConnection(err) || calls != 1 {
+		t.Errorf("expected one call failing on the closed connection, got %d calls and err=%v", calls, err)
+	}
+	lc.mu.Lock()
+	dropped := lc.persistentConn == nil
+	lc.mu.Unlock()
+	if !dropped {
+		t.Errorf("expected the closed connection to be dropped")
+	}
+}
+
+// closedConn returns a started ldap connection whose server hung up, once the
+// library has noticed and closed it. The ldap library doesn't synchronize its
+// closing flag, so using the connection before then is a data race.
+func closedConn() *ldap.Conn {
+	client, server := net.Pipe()
+	closed := make(chan struct{})
+	conn := ldap.NewConn(notifyCloseConn{client, closed}, false)
+	conn.Start()
+	server.Close()
+	<-closed
+	return conn
+}
+
+// notifyCloseConn closes a channel once it's closed.
+type notifyCloseConn struct {
+	net.Conn
+	closed chan struct{}
+}
+
+func (c notifyCloseConn) Close() error {
+	err := c.Conn.Close()
+	close(c.closed)
+	return err
+}
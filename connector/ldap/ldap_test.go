@@ -0,0 +1,3816 @@
+package ldap
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"gopkg.in/asn1-ber.v1"
+	"gopkg.in/ldap.v2"
+
+	"github.com/coreos/dex/connector"
+)
+
+func TestUniqueSorted(t *testing.T) {
+	tests := []struct {
+		in   []string
+		want []string
+	}{
+		{nil, nil},
+		{[]string{"admins"}, []string{"admins"}},
+		{
+			[]string{"developers", "admins", "developers", "admins"},
+			[]string{"admins", "developers"},
+		},
+		{
+			// Dedup is case sensitive.
+			[]string{"ops", "Ops", "ops"},
+			[]string{"Ops", "ops"},
+		},
+	}
+	for i, tc := range tests {
+		got := uniqueSorted(tc.in)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("case %d: uniqueSorted(%q): want=%q, got=%q", i, tc.in, tc.want, got)
+		}
+	}
+}
+
+func TestSASLExternalBind(t *testing.T) {
+	tests := []struct {
+		resultCode int64
+		wantErr    bool
+	}{
+		{ldap.LDAPResultSuccess, false},
+		{ldap.LDAPResultInvalidCredentials, true},
+	}
+	for i, tc := range tests {
+		client, server := net.Pipe()
+		go func() {
+			defer server.Close()
+			req, err := ber.ReadPacket(server)
+			if err != nil {
+				return
+			}
+			mechanism := req.Children[1].Children[2].Children[0].Value
+			if mechanism != "EXTERNAL" {
+				t.Errorf("case %d: expected mechanism EXTERNAL got %v", i, mechanism)
+			}
+
+			resp := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+			resp.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, rawMessageID, "MessageID"))
+			bindResp := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationBindResponse, nil, "Bind Response")
+			bindResp.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, tc.resultCode, "Result Code"))
+			bindResp.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Matched DN"))
+			bindResp.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Diagnostic Message"))
+			resp.AppendChild(bindResp)
+			server.Write(resp.Bytes())
+		}()
+
+		err := saslExternalBind(client)
+		client.Close()
+		if (err != nil) != tc.wantErr {
+			t.Errorf("case %d: wantErr=%t, got err=%v", i, tc.wantErr, err)
+		}
+	}
+}
+
+func TestUserSearchFilter(t *testing.T) {
+	tests := []struct {
+		name string
+
+		usernameAttr   StringList
+		filter         string
+		filterTemplate string
+		excludeFilter  string
+
+		username string
+		want     string
+	}{
+		{
+			name:         "username",
+			usernameAttr: StringList{"uid"},
+			username:     "jane",
+			want:         "(uid=jane)",
+		},
+		{
+			name:         "username and filter",
+			usernameAttr: StringList{"uid"},
+			filter:       "(objectClass=person)",
+			username:     "jane",
+			want:         "(&(objectClass=person)(uid=jane))",
+		},
+		{
+			name:         "multiple usernames",
+			usernameAttr: StringList{"sAMAccountName", "mail"},
+			filter:       "(objectClass=user)",
+			username:     "jane*",
+			want:         `(&(objectClass=user)(|(sAMAccountName=jane\2a)(mail=jane\2a)))`,
+		},
+		{
+			name:          "exclude filter",
+			usernameAttr:  StringList{"uid"},
+			filter:        "(objectClass=person)",
+			excludeFilter: "(nsAccountLock=TRUE)",
+			username:      "jane",
+			want:          "(&(objectClass=person)(uid=jane)(!(nsAccountLock=TRUE)))",
+		},
+		{
+			name:           "template with exclude filter",
+			filterTemplate: "(|(uid={{.Username}})(mail={{.Username}}))",
+			excludeFilter:  "(objectClass=computer)",
+			username:       "jane",
+			want:           "(&(|(uid=jane)(mail=jane))(!(objectClass=computer)))",
+		},
+		{
+			name:           "template",
+			filterTemplate: "(|(uid={{.Username}})(mail={{.Username}}))",
+			username:       "jane",
+			want:           "(|(uid=jane)(mail=jane))",
+		},
+		{
+			name:           "template escaping",
+			filterTemplate: "(|(uid={{.Username}})(mail={{.Username}}))",
+			username:       "*)(uid=*",
+			want:           `(|(uid=\2a\29\28uid=\2a)(mail=\2a\29\28uid=\2a))`,
+		},
+	}
+	for _, tc := range tests {
+		c := testConfig()
+		c.UserSearch.Username = tc.usernameAttr
+		c.UserSearch.Filter = tc.filter
+		c.UserSearch.FilterTemplate = tc.filterTemplate
+		c.UserSearch.ExcludeFilter = tc.excludeFilter
+
+		conn, err := c.OpenConnector()
+		if err != nil {
+			t.Errorf("%s: open connector: %v", tc.name, err)
+			continue
+		}
+		got, err := conn.(*ldapConnector).userSearchFilter(tc.username)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("%s: want=%q, got=%q", tc.name, tc.want, got)
+		}
+	}
+}
+
+// testConfig returns a minimal valid config.
+func testConfig() *Config {
+	c := new(Config)
+	c.Host = "ldap.example.com"
+	c.AnonymousBind = true
+	c.UserSearch.BaseDN = "ou=people,dc=example,dc=com"
+	c.UserSearch.Username = StringList{"uid"}
+	return c
+}
+
+func TestCloseIdempotent(t *testing.T) {
+	c := testConfig()
+	c.PersistentConnection = true
+	c.KeepAlive = "1h"
+	conn, err := c.OpenConnector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := conn.Close(); err != nil {
+			t.Errorf("close %d: %v", i, err)
+		}
+	}
+	if _, err := conn.(*ldapConnector).RootDSE(context.Background()); err == nil {
+		t.Errorf("expected request on closed connector to fail")
+	}
+}
+
+func TestGroupSearchValidation(t *testing.T) {
+	c := testConfig()
+	if _, err := c.OpenConnector(); err != nil {
+		t.Errorf("config without group search: %v", err)
+	}
+
+	c.GroupSearch.BaseDN = "ou=groups,dc=example,dc=com"
+	c.GroupSearch.UserAttr = "uid"
+	if _, err := c.OpenConnector(); err == nil {
+		t.Errorf("expected error for partial group search config")
+	}
+
+	c.GroupSearch.GroupAttr = "memberUid"
+	c.GroupSearch.NameAttr = "cn"
+	if _, err := c.OpenConnector(); err != nil {
+		t.Errorf("config with group search: %v", err)
+	}
+}
+
+func TestGroupSearchSet(t *testing.T) {
+	c := testConfig()
+	c.GroupSearch.RequiredGroups = []string{}
+	c.GroupSearch.RoleMapping = map[string]string{}
+	if c.groupSearchSet() {
+		t.Errorf("expected empty lists and maps not to count as set")
+	}
+
+	// Every field must be listed, or setting it alone skips validation.
+	fields := reflect.ValueOf(&c.GroupSearch).Elem()
+	for i := 0; i < fields.NumField(); i++ {
+		c := testConfig()
+		field := reflect.ValueOf(&c.GroupSearch).Elem().Field(i)
+		setNonZero(t, field)
+		if !c.groupSearchSet() {
+			t.Errorf("groupSearchSet doesn't check groupSearch field %s", fields.Type().Field(i).Name)
+		}
+	}
+}
+
+// setNonZero sets v, a config field, to a value other than its zero value.
+func setNonZero(t *testing.T, v reflect.Value) {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString("x")
+	case reflect.Bool:
+		v.SetBool(true)
+	case reflect.Int, reflect.Int64:
+		v.SetInt(1)
+	case reflect.Slice:
+		v.Set(reflect.MakeSlice(v.Type(), 1, 1))
+	case reflect.Map:
+		v.Set(reflect.MakeMap(v.Type()))
+		v.SetMapIndex(reflect.Zero(v.Type().Key()), reflect.Zero(v.Type().Elem()))
+	default:
+		t.Fatalf("unsupported field kind %s", v.Kind())
+	}
+}
+
+func TestGroupSearchFilterMatchUserDN(t *testing.T) {
+	c := testConfig()
+	c.GroupSearch.BaseDN = "ou=groups,dc=example,dc=com"
+	c.GroupSearch.Filter = "(objectClass=groupOfNames)"
+	c.GroupSearch.GroupAttr = "member"
+	c.GroupSearch.NameAttr = "cn"
+	c.GroupSearch.MatchUserDN = true
+	conn, err := c.OpenConnector()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A "DN" attribute on the entry must not be used.
+	user := ldap.NewEntry("cn=jane (admin),ou=people,dc=example,dc=com", map[string][]string{
+		"DN": {"cn=someone else"},
+	})
+	got := conn.(*ldapConnector).groupSearchFilter(*user)
+	want := `(&(objectClass=groupOfNames)(member=cn=jane \28admin\29,ou=people,dc=example,dc=com))`
+	if got != want {
+		t.Errorf("want=%q, got=%q", want, got)
+	}
+}
+
+func TestGroupSearchFilterMemberDNAttr(t *testing.T) {
+	c := testConfig()
+	c.GroupSearch.BaseDN = "ou=groups,dc=example,dc=com"
+	c.GroupSearch.Filter = "(|(objectClass=posixGroup)(objectClass=groupOfNames))"
+	c.GroupSearch.UserAttr = "uid"
+	c.GroupSearch.GroupAttr = "memberUid"
+	c.GroupSearch.MemberDNAttr = "member"
+	c.GroupSearch.NameAttr = "cn"
+	conn, err := c.OpenConnector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lc := conn.(*ldapConnector)
+
+	tests := []struct {
+		uid  []string
+		want string
+	}{
+		{[]string{"jane"}, `(&(|(objectClass=posixGroup)(objectClass=groupOfNames))(|(memberUid=jane)(member=uid=jane,ou=people,dc=example,dc=com)))`},
+		// Users without a uid are still matched by DN.
+		{nil, `(&(|(objectClass=posixGroup)(objectClass=groupOfNames))(member=uid=jane,ou=people,dc=example,dc=com))`},
+	}
+	for _, tc := range tests {
+		user := ldap.NewEntry("uid=jane,ou=people,dc=example,dc=com", map[string][]string{"uid": tc.uid})
+		if !lc.hasGroupMatchValue(*user) {
+			t.Errorf("uid %q: expected the user to have a value to match groups against", tc.uid)
+		}
+		if got := lc.groupSearchFilter(*user); got != tc.want {
+			t.Errorf("uid %q: want=%q, got=%q", tc.uid, tc.want, got)
+		}
+	}
+
+	c.GroupSearch.MatchUserDN = true
+	if _, err := c.OpenConnector(); err == nil {
+		t.Errorf("expected error combining memberDNAttr with matchUserDN")
+	}
+}
+
+func TestEscapeDN(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"jane", "jane"},
+		{"doe, jane", `doe\, jane`},
+		{"jane+admin", `jane\+admin`},
+		{"cn=admin", `cn\=admin`},
+		{`"quoted"`, `\"quoted\"`},
+		{`back\slash`, `back\\slash`},
+		{"<jane>;", `\<jane\>\;`},
+		{" jane ", `\ jane\ `},
+		{"#jane#", `\#jane#`},
+		{"nul\x00byte", `nul\00byte`},
+		{"jane,ou=admins,dc=example,dc=com", `jane\,ou\=admins\,dc\=example\,dc\=com`},
+		// Multibyte UTF-8 is left as is.
+		{"jäne", "jäne"},
+	}
+	for _, tc := range tests {
+		got := escapeDN(tc.in)
+		if got != tc.want {
+			t.Errorf("escapeDN(%q): want=%q, got=%q", tc.in, tc.want, got)
+		}
+		// The escaped value must parse as a single attribute value.
+		dn, err := ldap.ParseDN("uid=" + got + ",dc=example,dc=com")
+		if err != nil {
+			t.Errorf("escapeDN(%q): parse escaped DN: %v", tc.in, err)
+			continue
+		}
+		if len(dn.RDNs) != 3 || dn.RDNs[0].Attributes[0].Value != tc.in {
+			t.Errorf("escapeDN(%q): escaped DN parsed incorrectly: %#v", tc.in, dn.RDNs[0].Attributes[0])
+		}
+	}
+}
+
+func TestCheckActive(t *testing.T) {
+	tests := []struct {
+		name   string
+		config func(c *Config)
+		attrs  map[string][]string
+		active bool
+	}{
+		{
+			name:   "not configured",
+			config: func(c *Config) {},
+			active: true,
+		},
+		{
+			name: "active value",
+			config: func(c *Config) {
+				c.UserSearch.ActiveAttr = "accountStatus"
+				c.UserSearch.ActiveValues = []string{"active"}
+			},
+			attrs:  map[string][]string{"accountStatus": {"Active"}},
+			active: true,
+		},
+		{
+			name: "missing active value",
+			config: func(c *Config) {
+				c.UserSearch.ActiveAttr = "accountStatus"
+				c.UserSearch.ActiveValues = []string{"active"}
+			},
+			active: false,
+		},
+		{
+			name: "inactive value",
+			config: func(c *Config) {
+				c.UserSearch.ActiveAttr = "nsAccountLock"
+				c.UserSearch.InactiveValues = []string{"true"}
+			},
+			attrs:  map[string][]string{"nsAccountLock": {"TRUE"}},
+			active: false,
+		},
+		{
+			name: "no inactive value",
+			config: func(c *Config) {
+				c.UserSearch.ActiveAttr = "nsAccountLock"
+				c.UserSearch.InactiveValues = []string{"true"}
+			},
+			active: true,
+		},
+		{
+			name: "inactive bits",
+			config: func(c *Config) {
+				c.UserSearch.ActiveAttr = "userAccountControl"
+				c.UserSearch.InactiveBits = 2
+			},
+			attrs:  map[string][]string{"userAccountControl": {"514"}},
+			active: false,
+		},
+		{
+			name: "no inactive bits",
+			config: func(c *Config) {
+				c.UserSearch.ActiveAttr = "userAccountControl"
+				c.UserSearch.InactiveBits = 2
+			},
+			attrs:  map[string][]string{"userAccountControl": {"512"}},
+			active: true,
+		},
+	}
+	for _, tc := range tests {
+		c := testConfig()
+		tc.config(c)
+		conn, err := c.OpenConnector()
+		if err != nil {
+			t.Errorf("%s: open connector: %v", tc.name, err)
+			continue
+		}
+		entry := ldap.NewEntry("uid=jane,ou=people,dc=example,dc=com", tc.attrs)
+		err = conn.(*ldapConnector).checkActive(*entry)
+		if active := err == nil; active != tc.active {
+			t.Errorf("%s: want active=%t, got err=%v", tc.name, tc.active, err)
+		}
+	}
+}
+
+func TestUserSearchBaseDN(t *testing.T) {
+	c := testConfig()
+	c.UserSearch.Scope = "base"
+	c.UserSearch.BaseDN = "ou=people,dc=example,dc=com"
+	if _, err := c.OpenConnector(); err == nil {
+		t.Errorf("expected error for base scope without a username in baseDN")
+	}
+
+	c.UserSearch.BaseDN = "uid={{.Username}},ou=people,dc=example,dc=com"
+	conn, err := c.OpenConnector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := conn.(*ldapConnector).userSearchBaseDN("doe, jane")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `uid=doe\, jane,ou=people,dc=example,dc=com`; got != want {
+		t.Errorf("want=%q, got=%q", want, got)
+	}
+}
+
+func TestInvalidConfigFieldPath(t *testing.T) {
+	// Sets the fields required by any groupSearch option.
+	groupSearch := func(c *Config) {
+		c.GroupSearch.BaseDN = "ou=groups,dc=example,dc=com"
+		c.GroupSearch.UserAttr = "uid"
+		c.GroupSearch.GroupAttr = "memberUid"
+		c.GroupSearch.NameAttr = "cn"
+	}
+	tests := []struct {
+		name   string
+		modify func(c *Config)
+		field  string
+	}{
+		{"user scope", func(c *Config) { c.UserSearch.Scope = "subtree" }, "userSearch.scope"},
+		{"group scope", func(c *Config) { groupSearch(c); c.GroupSearch.Scope = "subtree" }, "groupSearch.scope"},
+		{"deref aliases", func(c *Config) { c.DerefAliases = "sometimes" }, "derefAliases"},
+		{"tls renegotiation", func(c *Config) { c.TLSRenegotiation = "always" }, "tlsRenegotiation"},
+		{"tls session cache", func(c *Config) { c.TLSSessionCacheSize = -1 }, "tlsSessionCacheSize"},
+		{"on multiple", func(c *Config) { c.UserSearch.OnMultiple = "last" }, "userSearch.onMultiple"},
+		{"bind mode", func(c *Config) { c.BindMode = "sasl" }, "bindMode"},
+		{"protocol version", func(c *Config) { c.ProtocolVersion = 2 }, "protocolVersion"},
+		{"exclude filter", func(c *Config) { c.UserSearch.ExcludeFilter = "objectClass=computer" }, "userSearch.excludeFilter"},
+		{"size limit", func(c *Config) { groupSearch(c); c.GroupSearch.SizeLimit = -1 }, "groupSearch.sizeLimit"},
+		{"cache ttl", func(c *Config) { groupSearch(c); c.GroupSearch.CacheTTL = "-1m" }, "groupSearch.cacheTTL"},
+		{"bind result code", func(c *Config) { c.BindResultCodes.AccountProblem = []int{0} }, "bindResultCodes.accountProblem[0]"},
+		{"client bind result code", func(c *Config) {
+			c.BindResultCodes.InvalidCredentials = []int{49, ldap.ErrorNetwork}
+		}, "bindResultCodes.invalidCredentials[1]"},
+		{"bind result code in both lists", func(c *Config) {
+			c.BindResultCodes.InvalidCredentials = []int{49, 53}
+		}, "bindResultCodes"},
+		{"fallback base dns", func(c *Config) { c.UserSearch.FallbackBaseDNs = []string{"not a dn"} }, "userSearch.fallbackBaseDNs[0]"},
+		{"fallback base dns with bind dn template", func(c *Config) {
+			c.UserSearch.BindDNTemplate = "uid={{.Username}},ou=people,dc=example,dc=com"
+			c.UserSearch.FallbackBaseDNs = []string{"ou=contractors,dc=example,dc=com"}
+		}, "userSearch.fallbackBaseDNs"},
+	}
+	for _, tc := range tests {
+		c := testConfig()
+		tc.modify(c)
+		_, err := c.OpenConnector()
+		if err == nil {
+			t.Errorf("%s: expected error", tc.name)
+			continue
+		}
+		if !strings.Contains(err.Error(), tc.field) {
+			t.Errorf("%s: expected error to mention %q, got %q", tc.name, tc.field, err)
+		}
+	}
+}
+
+func TestSearchAdminLimitExceeded(t *testing.T) {
+	conn, err := testConfig().OpenConnector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := conn.(*ldapConnector)
+
+	client, server := net.Pipe()
+	// The server's end is closed after the client's. The ldap library doesn't
+	// synchronize a connection closed by the server with the search finishing.
+	clientClosed := make(chan struct{})
+	go func() {
+		defer server.Close()
+		defer func() { <-clientClosed }()
+		req, err := ber.ReadPacket(server)
+		if err != nil {
+			return
+		}
+		resp := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+		resp.AppendChild(req.Children[0])
+		done := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultDone, nil, "Search Result Done")
+		done.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(ldap.LDAPResultAdminLimitExceeded), "Result Code"))
+		done.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Matched DN"))
+		done.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Diagnostic Message"))
+		resp.AppendChild(done)
+		server.Write(resp.Bytes())
+	}()
+
+	ldapConn := ldap.NewConn(client, false)
+	ldapConn.Start()
+
+	req := &ldap.SearchRequest{
+		BaseDN: "ou=groups,dc=example,dc=com",
+		Filter: "(member=uid=jane)",
+		Scope:  ldap.ScopeWholeSubtree,
+	}
+	_, err = c.search(context.Background(), ldapConn, req)
+	ldapConn.Close()
+	close(clientClosed)
+	var limitErr *AdminLimitError
+	if !errors.As(err, &limitErr) {
+		t.Fatalf("expected an admin limit error, got %v", err)
+	}
+	if limitErr.BaseDN != req.BaseDN || limitErr.Filter != req.Filter {
+		t.Errorf("unexpected base DN %q or filter %q", limitErr.BaseDN, limitErr.Filter)
+	}
+	if !isResultCode(err, ldap.LDAPResultAdminLimitExceeded) {
+		t.Errorf("expected error to wrap the result code")
+	}
+}
+
+func TestStringListUnmarshal(t *testing.T) {
+	tests := []struct {
+		in   string
+		want StringList
+	}{
+		{`"uid"`, StringList{"uid"}},
+		{`["sAMAccountName", "mail"]`, StringList{"sAMAccountName", "mail"}},
+		{`[]`, StringList{}},
+	}
+	for _, tc := range tests {
+		var got StringList
+		if err := json.Unmarshal([]byte(tc.in), &got); err != nil {
+			t.Errorf("%s: %v", tc.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: want=%q, got=%q", tc.in, tc.want, got)
+		}
+	}
+	var l StringList
+	if err := json.Unmarshal([]byte(`1`), &l); err == nil {
+		t.Errorf("expected error unmarshaling a number")
+	}
+}
+
+func TestConnectorDataExposeAttributes(t *testing.T) {
+	c := testConfig()
+	c.UserSearch.ExposeAttributes = []string{"department", "employeeNumber", "manager"}
+	conn, err := c.OpenConnector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := ldap.NewEntry("uid=jane,ou=people,dc=example,dc=com", map[string][]string{
+		"uid":            {"jane"},
+		"Department":     {"Engineering"},
+		"employeeNumber": {"1234"},
+		"userPassword":   {"secret"},
+	})
+	data, err := conn.(*ldapConnector).connectorData(connector.Scopes{}, "jane", *user, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]string{
+		"department":     {"Engineering"},
+		"employeeNumber": {"1234"},
+	}
+	if !reflect.DeepEqual(data.Attributes, want) {
+		t.Errorf("want=%v, got=%v", want, data.Attributes)
+	}
+	if data.DN != "" {
+		t.Errorf("expected DN not to be exposed, got %q", data.DN)
+	}
+	if data.Entry.DN != user.DN || len(data.Entry.Attributes) != 0 {
+		t.Errorf("expected only the entry's DN to be stored, got %+v", data.Entry)
+	}
+}
+
+func TestLoginConnectorDataOnlyExposedAttributes(t *testing.T) {
+	addr, stop := fakeServer(t, func(req *ber.Packet, controls []ldap.Control) []fakeResponse {
+		return []fakeResponse{
+			{op: fakeEntry("uid=jane,ou=people,dc=example,dc=com", map[string][]string{
+				"uid":          {"jane"},
+				"mail":         {"jane@example.com"},
+				"department":   {"Engineering"},
+				"employeeType": {"contractor"},
+			})},
+			{op: fakeResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)},
+		}
+	})
+	defer stop()
+
+	c := testConfig()
+	c.Host = addr
+	c.InsecureNoSSL = true
+	c.UserSearch.IDAttr = "uid"
+	c.UserSearch.EmailAttr = "mail"
+	c.UserSearch.ExposeAttributes = []string{"department"}
+	conn, err := c.OpenConnector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	ident, valid, err := conn.Login(context.Background(), connector.Scopes{OfflineAccess: true}, "jane", "password")
+	if err != nil || !valid {
+		t.Fatalf("login failed: valid=%t err=%v", valid, err)
+	}
+	// Only the username, the DN, and the exposed attribute are stored.
+	for _, value := range []string{"jane@example.com", "contractor"} {
+		if bytes.Contains(ident.ConnectorData, []byte(value)) {
+			t.Errorf("connector data contains %q: %s", value, ident.ConnectorData)
+		}
+	}
+	if !bytes.Contains(ident.ConnectorData, []byte("Engineering")) {
+		t.Errorf("connector data missing the exposed attribute: %s", ident.ConnectorData)
+	}
+}
+
+func TestConnectorDataLocale(t *testing.T) {
+	c := testConfig()
+	c.UserSearch.LocaleAttr = "preferredLanguage"
+	c.UserSearch.ZoneinfoAttr = "timezone"
+	conn, err := c.OpenConnector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lc := conn.(*ldapConnector)
+	requested := make(map[string]bool)
+	for _, attr := range lc.userAttributes() {
+		requested[attr] = true
+	}
+	if !requested["preferredLanguage"] || !requested["timezone"] {
+		t.Errorf("expected locale and zoneinfo attributes to be requested, got %q", lc.userAttributes())
+	}
+
+	tests := []struct {
+		attrs        map[string][]string
+		wantLocale   string
+		wantZoneinfo string
+	}{
+		{attrs: map[string][]string{"preferredLanguage": {"fr-CA"}, "timezone": {"America/Toronto"}}, wantLocale: "fr-CA", wantZoneinfo: "America/Toronto"},
+		{attrs: map[string][]string{"preferredLanguage": {"da, en-gb;q=0.8, en;q=0.7"}}, wantLocale: "da"},
+		{attrs: map[string][]string{"preferredLanguage": {"en;q=0.9"}}, wantLocale: "en"},
+		// Missing attributes are left empty.
+		{},
+	}
+	for _, test := range tests {
+		user := ldap.NewEntry("uid=jane,ou=people,dc=example,dc=com", test.attrs)
+		data, err := lc.connectorData(connector.Scopes{}, "jane", *user, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data.Locale != test.wantLocale || data.Zoneinfo != test.wantZoneinfo {
+			t.Errorf("%v: want locale=%q zoneinfo=%q, got locale=%q zoneinfo=%q",
+				test.attrs, test.wantLocale, test.wantZoneinfo, data.Locale, data.Zoneinfo)
+		}
+	}
+}
+
+func TestConnectorDataRisk(t *testing.T) {
+	c := testConfig()
+	c.UserSearch.MFAEnrolledAttr = "mfaMethod"
+	c.UserSearch.MFAEnrolledValues = []string{"totp", "webauthn"}
+	c.UserSearch.HighRiskBaseDNs = []string{"OU=Admins,dc=example,dc=com"}
+	conn, err := c.OpenConnector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lc := conn.(*ldapConnector)
+
+	tests := []struct {
+		dn              string
+		attrs           map[string][]string
+		wantMFAEnrolled bool
+		wantHighRisk    bool
+	}{
+		{dn: "uid=jane,ou=people,dc=example,dc=com", attrs: map[string][]string{"mfaMethod": {"sms", "TOTP"}}, wantMFAEnrolled: true},
+		{dn: "uid=jane,ou=people,dc=example,dc=com", attrs: map[string][]string{"mfaMethod": {"sms"}}},
+		{dn: "uid=jane,ou=people,dc=example,dc=com"},
+		{dn: "uid=root,ou=admins,dc=example,dc=com", wantHighRisk: true},
+		{dn: "uid=root,ou=ops,ou=admins,dc=example,dc=com", wantHighRisk: true},
+		{dn: "uid=root,ou=admins,dc=other,dc=com"},
+	}
+	for _, test := range tests {
+		user := ldap.NewEntry(test.dn, test.attrs)
+		data, err := lc.connectorData(connector.Scopes{}, "jane", *user, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data.MFAEnrolled != test.wantMFAEnrolled || data.HighRisk != test.wantHighRisk {
+			t.Errorf("%s %v: want mfaEnrolled=%t highRisk=%t, got mfaEnrolled=%t highRisk=%t",
+				test.dn, test.attrs, test.wantMFAEnrolled, test.wantHighRisk, data.MFAEnrolled, data.HighRisk)
+		}
+	}
+
+	c.UserSearch.MFAEnrolledValues = nil
+	conn, err = c.OpenConnector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := ldap.NewEntry("uid=jane,ou=people,dc=example,dc=com", map[string][]string{"mfaMethod": {"sms"}})
+	if data, err := conn.(*ldapConnector).connectorData(connector.Scopes{}, "jane", *user, nil); err != nil || !data.MFAEnrolled {
+		t.Errorf("expected any value to mark the user as enrolled without mfaEnrolledValues")
+	}
+
+	user = ldap.NewEntry("not a dn", nil)
+	if _, err := conn.(*ldapConnector).connectorData(connector.Scopes{}, "jane", *user, nil); err == nil {
+		t.Errorf("expected error for a user DN that can't be parsed")
+	}
+
+	c.UserSearch.HighRiskBaseDNs = []string{"not a dn"}
+	if _, err := c.OpenConnector(); err == nil {
+		t.Errorf("expected error for an invalid highRiskBaseDNs entry")
+	}
+}
+
+func TestLookupIdentityDisabled(t *testing.T) {
+	conn, err := testConfig().OpenConnector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Must fail before contacting the server.
+	_, found, err := conn.(*ldapConnector).LookupIdentity(context.Background(), connector.Scopes{}, "jane")
+	if err == nil || found {
+		t.Errorf("expected lookup to be rejected, got found=%t err=%v", found, err)
+	}
+}
+
+func TestLookupIdentity(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		binds []string
+	)
+	addr, stop := fakeServerBinds(t, func(dn, password string) *ber.Packet {
+		mu.Lock()
+		binds = append(binds, dn)
+		mu.Unlock()
+		return fakeResult(ldap.ApplicationBindResponse, ldap.LDAPResultSuccess)
+	}, func(boundDN string, req *ber.Packet, controls []ldap.Control) []fakeResponse {
+		filter, err := ldap.DecompileFilter(req.Children[6])
+		if err != nil {
+			t.Errorf("decompile filter: %v", err)
+		}
+		switch filter {
+		case "(memberUid=jane)":
+			return []fakeResponse{
+				{op: fakeEntry("cn=admins,ou=groups,dc=example,dc=com", map[string][]string{"cn": {"admins"}})},
+				{op: fakeResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)},
+			}
+		case "(uid=jane)":
+			return []fakeResponse{
+				{op: fakeEntry("uid=jane,ou=people,dc=example,dc=com", map[string][]string{"uid": {"jane"}, "mail": {"jane@example.com"}})},
+				{op: fakeResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)},
+			}
+		}
+		return []fakeResponse{{op: fakeResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)}}
+	})
+	defer stop()
+
+	c := testConfig()
+	c.Host = addr
+	c.InsecureNoSSL = true
+	c.AnonymousBind = false
+	c.BindDN = "cn=admin,dc=example,dc=com"
+	c.BindPW = "admin"
+	c.AllowIdentityLookup = true
+	c.UserSearch.IDAttr = "uid"
+	c.UserSearch.EmailAttr = "mail"
+	c.GroupSearch.BaseDN = "ou=groups,dc=example,dc=com"
+	c.GroupSearch.UserAttr = "uid"
+	c.GroupSearch.GroupAttr = "memberUid"
+	c.GroupSearch.NameAttr = "cn"
+	conn, err := c.OpenConnector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	lc := conn.(*ldapConnector)
+
+	ident, found, err := lc.LookupIdentity(context.Background(), connector.Scopes{Groups: true}, "jane")
+	if err != nil || !found {
+		t.Fatalf("expected jane to be found, got found=%t err=%v", found, err)
+	}
+	if ident.UserID != "jane" || ident.Email != "jane@example.com" || !reflect.DeepEqual(ident.Groups, []string{"admins"}) {
+		t.Errorf("unexpected identity %+v", ident)
+	}
+	mu.Lock()
+	for _, dn := range binds {
+		if dn != c.BindDN {
+			t.Errorf("expected only service account binds, got a bind as %q", dn)
+		}
+	}
+	mu.Unlock()
+
+	if _, found, err := lc.LookupIdentity(context.Background(), connector.Scopes{}, "john"); err != nil || found {
+		t.Errorf("expected unknown user not to be found, got found=%t err=%v", found, err)
+	}
+}
+
+func TestConnectorDataChangeMarker(t *testing.T) {
+	c := testConfig()
+	c.UserSearch.ChangeMarkerAttr = "modifyTimestamp"
+	conn, err := c.OpenConnector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lc := conn.(*ldapConnector)
+	want := []string{"modifyTimestamp", "uid"}
+	if attrs := lc.userAttributes(); !reflect.DeepEqual(attrs, want) {
+		t.Errorf("want=%q, got=%q", want, attrs)
+	}
+
+	user := ldap.NewEntry("uid=jane,ou=people,dc=example,dc=com", map[string][]string{
+		"modifyTimestamp": {"20170101000000Z"},
+	})
+	data, err := lc.connectorData(connector.Scopes{}, "jane", *user, []Group{{Name: "admins"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data.ChangeMarker != "20170101000000Z" {
+		t.Errorf("unexpected change marker %q", data.ChangeMarker)
+	}
+}
+
+func TestRefreshChangeMarker(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		member   = true
+		locked   = false
+		subtrees int
+	)
+	addr, stop := fakeServer(t, func(req *ber.Packet, controls []ldap.Control) []fakeResponse {
+		mu.Lock()
+		defer mu.Unlock()
+		if baseDN, _ := req.Children[0].Value.(string); baseDN == "ou=groups,dc=example,dc=com" {
+			if !member {
+				return []fakeResponse{{op: fakeResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)}}
+			}
+			return []fakeResponse{
+				{op: fakeEntry("cn=vpn-users,ou=groups,dc=example,dc=com", map[string][]string{"cn": {"vpn-users"}})},
+				{op: fakeResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)},
+			}
+		}
+		if scope, _ := req.Children[1].Value.(int64); scope != int64(ldap.ScopeBaseObject) {
+			subtrees++
+		}
+		attrs := map[string][]string{
+			"uid":             {"jane"},
+			"mail":            {"jane@example.com"},
+			"modifyTimestamp": {"20170101000000Z"},
+		}
+		if locked {
+			attrs["nsAccountLock"] = []string{"TRUE"}
+		}
+		return []fakeResponse{
+			{op: fakeEntry("uid=jane,ou=people,dc=example,dc=com", attrs)},
+			{op: fakeResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)},
+		}
+	})
+	defer stop()
+
+	c := testConfig()
+	c.Host = addr
+	c.InsecureNoSSL = true
+	c.UserSearch.IDAttr = "uid"
+	c.UserSearch.EmailAttr = "mail"
+	c.UserSearch.ChangeMarkerAttr = "modifyTimestamp"
+	c.UserSearch.ActiveAttr = "nsAccountLock"
+	c.UserSearch.InactiveValues = []string{"TRUE"}
+	c.GroupSearch.BaseDN = "ou=groups,dc=example,dc=com"
+	c.GroupSearch.UserAttr = "uid"
+	c.GroupSearch.GroupAttr = "memberUid"
+	c.GroupSearch.NameAttr = "cn"
+	c.GroupSearch.RequiredGroups = []string{"vpn-users"}
+	conn, err := c.OpenConnector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	s := connector.Scopes{OfflineAccess: true, Groups: true}
+	ident, valid, err := conn.Login(context.Background(), s, "jane", "password")
+	if err != nil || !valid {
+		t.Fatalf("login failed: valid=%t err=%v", valid, err)
+	}
+
+	mu.Lock()
+	subtrees = 0
+	mu.Unlock()
+	refreshed, err := conn.Refresh(context.Background(), s, ident)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refreshed.UserID != "jane" || !reflect.DeepEqual(refreshed.Groups, []string{"vpn-users"}) {
+		t.Errorf("unexpected refreshed identity %+v", refreshed)
+	}
+	mu.Lock()
+	if subtrees != 0 {
+		t.Errorf("expected the user entry to be read by DN, got %d user searches", subtrees)
+	}
+	// Neither of these changes the marker.
+	member = false
+	mu.Unlock()
+	if _, err := conn.Refresh(context.Background(), s, ident); err == nil {
+		t.Errorf("expected refresh to fail once the user left the required group")
+	}
+
+	mu.Lock()
+	member, locked = true, true
+	mu.Unlock()
+	if _, err := conn.Refresh(context.Background(), s, ident); err == nil {
+		t.Errorf("expected refresh of a locked account to fail")
+	}
+}
+
+func TestTLSTuning(t *testing.T) {
+	c := testConfig()
+	c.TLSSessionCacheSize = 64
+	c.TLSRenegotiation = "once"
+	conn, err := c.OpenConnector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig := conn.(*ldapConnector).tlsConfig
+	if tlsConfig.ClientSessionCache == nil {
+		t.Errorf("expected a TLS session cache")
+	}
+	if tlsConfig.Renegotiation != tls.RenegotiateOnceAsClient {
+		t.Errorf("unexpected renegotiation support %v", tlsConfig.Renegotiation)
+	}
+}
+
+func TestBindDNTemplate(t *testing.T) {
+	c := new(Config)
+	c.Host = "ldap.example.com"
+	c.AnonymousBind = true
+	c.UserSearch.BindDNTemplate = "uid={{.Username}},ou=people,dc=example,dc=com"
+	conn, err := c.OpenConnector()
+	if err != nil {
+		t.Fatalf("baseDN and username should be optional with a bind DN template: %v", err)
+	}
+	lc := conn.(*ldapConnector)
+
+	got, err := lc.userBindDNFor("jane,ou=admins")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `uid=jane\,ou\=admins,ou=people,dc=example,dc=com`; got != want {
+		t.Errorf("want=%q, got=%q", want, got)
+	}
+
+	// Must be rejected before contacting the server.
+	_, valid, err := lc.Login(context.Background(), connector.Scopes{}, "jane", "")
+	if err != nil || valid {
+		t.Errorf("expected empty password to be invalid, got valid=%t err=%v", valid, err)
+	}
+
+	c.UserSearch.BindDNTemplate = "uid=jane,ou=people,dc=example,dc=com"
+	if _, err := c.OpenConnector(); err == nil {
+		t.Errorf("expected error for bind DN template without a username")
+	}
+}
+
+func TestReadEntryAsUser(t *testing.T) {
+	const userDN = "uid=jane,ou=people,dc=example,dc=com"
+	var (
+		mu         sync.Mutex
+		hidden     bool
+		userReads  int
+		userScopes []int64
+	)
+	addr, stop := fakeServerBinds(t, func(dn, password string) *ber.Packet {
+		if dn != "" && password != "password" {
+			return fakeResult(ldap.ApplicationBindResponse, ldap.LDAPResultInvalidCredentials)
+		}
+		return fakeResult(ldap.ApplicationBindResponse, ldap.LDAPResultSuccess)
+	}, func(boundDN string, req *ber.Packet, controls []ldap.Control) []fakeResponse {
+		done := fakeResponse{op: fakeResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)}
+		name := "Service View"
+		if boundDN == userDN {
+			mu.Lock()
+			userReads++
+			scope, _ := req.Children[1].Value.(int64)
+			userScopes = append(userScopes, scope)
+			h := hidden
+			mu.Unlock()
+			if h {
+				return []fakeResponse{done}
+			}
+			name = "Jane Doe"
+		}
+		return []fakeResponse{
+			{op: fakeEntry(userDN, map[string][]string{"uid": {"jane"}, "mail": {"jane@example.com"}, "cn": {name}})},
+			done,
+		}
+	})
+	defer stop()
+
+	for _, persistent := range []bool{false, true} {
+		c := testConfig()
+		c.Host = addr
+		c.InsecureNoSSL = true
+		c.PersistentConnection = persistent
+		c.UserSearch.IDAttr = "uid"
+		c.UserSearch.EmailAttr = "mail"
+		c.UserSearch.NameAttr = StringList{"cn"}
+		c.UserSearch.ReadEntryAsUser = true
+		conn, err := c.OpenConnector()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, test := range []struct {
+			hidden bool
+			want   string
+		}{
+			{false, "Jane Doe"},
+			// The user can't read their own entry, so the service account's
+			// view is used.
+			{true, "Service View"},
+		} {
+			mu.Lock()
+			hidden, userReads, userScopes = test.hidden, 0, nil
+			mu.Unlock()
+
+			ident, valid, err := conn.Login(context.Background(), connector.Scopes{}, "jane", "password")
+			if err != nil || !valid {
+				t.Fatalf("persistent=%t hidden=%t: login failed: valid=%t err=%v", persistent, test.hidden, valid, err)
+			}
+			if ident.Username != test.want {
+				t.Errorf("persistent=%t hidden=%t: want username %q, got %q", persistent, test.hidden, test.want, ident.Username)
+			}
+			mu.Lock()
+			if userReads != 1 || userScopes[0] != int64(ldap.ScopeBaseObject) {
+				t.Errorf("persistent=%t hidden=%t: expected one base search bound as the user, got scopes %v", persistent, test.hidden, userScopes)
+			}
+			mu.Unlock()
+		}
+		conn.Close()
+	}
+}
+
+func TestBindProtocolError(t *testing.T) {
+	addr, stop := fakeServerBinds(t, func(dn, password string) *ber.Packet {
+		if dn != "" {
+			return fakeResult(ldap.ApplicationBindResponse, ldap.LDAPResultProtocolError)
+		}
+		return fakeResult(ldap.ApplicationBindResponse, ldap.LDAPResultSuccess)
+	}, func(boundDN string, req *ber.Packet, controls []ldap.Control) []fakeResponse {
+		return []fakeResponse{
+			{op: fakeEntry("uid=jane,ou=people,dc=example,dc=com", map[string][]string{"uid": {"jane"}, "mail": {"jane@example.com"}})},
+			{op: fakeResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)},
+		}
+	})
+	defer stop()
+
+	c := testConfig()
+	c.Host = addr
+	c.InsecureNoSSL = true
+	c.UserSearch.IDAttr = "uid"
+	c.UserSearch.EmailAttr = "mail"
+	conn, err := c.OpenConnector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	_, _, err = conn.Login(context.Background(), connector.Scopes{}, "jane", "password")
+	if err == nil {
+		t.Fatal("expected a protocol error to fail the login")
+	}
+	if !strings.Contains(err.Error(), "it may only support LDAPv2") {
+		t.Errorf("expected the error to suggest an LDAPv2 server, got %v", err)
+	}
+	var ldapErr *ldap.Error
+	if !errors.As(err, &ldapErr) || ldapErr.ResultCode != ldap.LDAPResultProtocolError {
+		t.Errorf("expected the error to wrap the protocol error, got %#v", err)
+	}
+}
+
+func TestLoginEmptyPassword(t *testing.T) {
+	var (
+		mu        sync.Mutex
+		userBinds int
+	)
+	addr, stop := fakeServerBinds(t, func(dn, password string) *ber.Packet {
+		// Accept unauthenticated binds like many servers do.
+		if dn != "" {
+			mu.Lock()
+			userBinds++
+			mu.Unlock()
+		}
+		return fakeResult(ldap.ApplicationBindResponse, ldap.LDAPResultSuccess)
+	}, func(boundDN string, req *ber.Packet, controls []ldap.Control) []fakeResponse {
+		return []fakeResponse{
+			{op: fakeEntry("uid=jane,ou=people,dc=example,dc=com", map[string][]string{"uid": {"jane"}, "mail": {"jane@example.com"}})},
+			{op: fakeResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)},
+		}
+	})
+	defer stop()
+
+	c := testConfig()
+	c.Host = addr
+	c.InsecureNoSSL = true
+	c.UserSearch.IDAttr = "uid"
+	c.UserSearch.EmailAttr = "mail"
+	conn, err := c.OpenConnector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	_, valid, err := conn.Login(context.Background(), connector.Scopes{}, "jane", "")
+	if err != nil || valid {
+		t.Errorf("expected empty password to be invalid, got valid=%t err=%v", valid, err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if userBinds != 0 {
+		t.Errorf("expected no bind as the user, got %d", userBinds)
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	c := testConfig()
+	conn, err := c.OpenConnector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Capabilities{Password: true, Refresh: true}
+	if got := conn.(*ldapConnector).Capabilities(); got != want {
+		t.Errorf("want=%+v, got=%+v", want, got)
+	}
+
+	c.GroupSearch.BaseDN = "ou=groups,dc=example,dc=com"
+	c.GroupSearch.UserAttr = "uid"
+	c.GroupSearch.GroupAttr = "memberUid"
+	c.GroupSearch.NameAttr = "cn"
+	c.AllowIdentityLookup = true
+	c.AllowUserListing = true
+	if conn, err = c.OpenConnector(); err != nil {
+		t.Fatal(err)
+	}
+	want = Capabilities{Password: true, Refresh: true, Groups: true, IdentityLookup: true, UserListing: true}
+	if got := conn.(*ldapConnector).Capabilities(); got != want {
+		t.Errorf("want=%+v, got=%+v", want, got)
+	}
+}
+
+func TestFailoverHosts(t *testing.T) {
+	// An address with nothing listening.
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	// Hand accepted connections to the test, which closes them once the
+	// client is done with them. Closing them right away races with the ldap
+	// library's reader.
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		accepted <- conn
+	}()
+
+	c := testConfig()
+	c.Host = closed.Addr().String()
+	c.InsecureNoSSL = true
+	c.FailoverHosts = []HostConfig{
+		{Host: l.Addr().String(), InsecureNoSSL: true},
+		{Host: "dr.example.com", ServerName: "ldap.dr.example.com"},
+	}
+	conn, err := c.OpenConnector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lc := conn.(*ldapConnector)
+
+	dr := lc.endpoints[2]
+	if dr.addr != "dr.example.com:636" || !dr.useTLS || dr.tlsConfig.ServerName != "ldap.dr.example.com" {
+		t.Errorf("unexpected failover endpoint %+v", dr)
+	}
+
+	ldapConn, err := lc.connectAny(context.Background(), false)
+	if err != nil {
+		t.Fatalf("expected failover to the second host: %v", err)
+	}
+	ldapConn.Close()
+	(<-accepted).Close()
+
+	c.FailoverHosts = []HostConfig{{}}
+	if _, err := c.OpenConnector(); err == nil || !strings.Contains(err.Error(), "failoverHosts[0].host") {
+		t.Errorf("expected error naming the missing host, got %v", err)
+	}
+}
+
+func TestIDHash(t *testing.T) {
+	c := testConfig()
+	c.UserSearch.IDAttr = "mail"
+	c.UserSearch.EmailAttr = "mail"
+	c.UserSearch.IDHash = "sha256"
+	conn, err := c.OpenConnector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := ldap.NewEntry("uid=jane,ou=people,dc=example,dc=com", map[string][]string{
+		"mail": {"jane@example.com"},
+	})
+	ident, err := conn.(*ldapConnector).identityFromEntry(*user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// echo -n jane@example.com | sha256sum
+	want := "8c87b489ce35cf2e2f39f80e282cb2e804932a56a213983eeeb428407d43b52d"
+	if ident.UserID != want {
+		t.Errorf("want=%q, got=%q", want, ident.UserID)
+	}
+	if ident.Email != "jane@example.com" {
+		t.Errorf("expected email not to be hashed, got %q", ident.Email)
+	}
+
+	c.UserSearch.IDHash = "md5"
+	if _, err := c.OpenConnector(); err == nil {
+		t.Errorf("expected error for unknown hash")
+	}
+}
+
+func TestUserAttributes(t *testing.T) {
+	c := testConfig()
+	c.UserSearch.IDAttr = "uid"
+	c.UserSearch.EmailAttr = "mail"
+	c.UserSearch.NameAttr = StringList{"cn"}
+	c.UserSearch.ExposeAttributes = []string{"Mail", "department"}
+	c.GroupSearch.BaseDN = "ou=groups,dc=example,dc=com"
+	c.GroupSearch.UserAttr = "uid"
+	c.GroupSearch.GroupAttr = "memberUid"
+	c.GroupSearch.NameAttr = "cn"
+	conn, err := c.OpenConnector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"uid", "mail", "cn", "department"}
+	if got := conn.(*ldapConnector).userAttributes(); !reflect.DeepEqual(got, want) {
+		t.Errorf("want=%q, got=%q", want, got)
+	}
+}
+
+func TestSearchGroupsMissingUserAttr(t *testing.T) {
+	c := testConfig()
+	c.GroupSearch.BaseDN = "ou=groups,dc=example,dc=com"
+	c.GroupSearch.UserAttr = "uid"
+	c.GroupSearch.GroupAttr = "memberUid"
+	c.GroupSearch.NameAttr = "cn"
+	conn, err := c.OpenConnector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := ldap.NewEntry("cn=jane,ou=people,dc=example,dc=com", nil)
+
+	// Must return before contacting the server.
+	groups, err := conn.(*ldapConnector).groups(context.Background(), *user)
+	if err != nil || len(groups) != 0 {
+		t.Errorf("expected no groups, got %q, err=%v", groups, err)
+	}
+
+	c.GroupSearch.FailOnEmpty = true
+	if conn, err = c.OpenConnector(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.(*ldapConnector).searchGroups(context.Background(), *user); err == nil {
+		t.Errorf("expected error with failOnEmpty")
+	}
+
+	// Fails even if the user has a primary group, which would otherwise be
+	// returned.
+	c.GroupSearch.FailOnEmpty = false
+	c.GroupSearch.RequireUserAttr = true
+	c.GroupSearch.PrimaryGroup = "posix"
+	c.GroupSearch.CacheTTL = "1m"
+	user = ldap.NewEntry("cn=jane,ou=people,dc=example,dc=com", map[string][]string{"gidNumber": {"100"}})
+	var buf bytes.Buffer
+	if conn, err = c.OpenConnector(WithLogger(log.New(&buf, "", 0))); err != nil {
+		t.Fatal(err)
+	}
+	// Checked without the groups scope, and before the groups cache.
+	lc := conn.(*ldapConnector)
+	lc.groupCache.set(user.DN, []Group{{Name: "cached"}})
+	if _, _, err := lc.identityForUser(context.Background(), connector.Scopes{}, "jane", *user); err == nil {
+		t.Errorf("expected error with requireUserAttr")
+	}
+	if got := buf.String(); !strings.Contains(got, `"cn=jane,ou=people,dc=example,dc=com"`) || !strings.Contains(got, `"uid"`) {
+		t.Errorf("expected log naming the user and attribute, got %q", got)
+	}
+
+	c.GroupSearch.MatchUserDN = true
+	if _, err := c.OpenConnector(); err == nil {
+		t.Errorf("expected error for requireUserAttr with matchUserDN")
+	}
+}
+
+func TestIdentityFromEntryWithoutAttributes(t *testing.T) {
+	c := testConfig()
+	c.UserSearch.IDAttr = "uid"
+	c.UserSearch.EmailAttr = "mail"
+	conn, err := c.OpenConnector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lc := conn.(*ldapConnector)
+
+	// Access controls hide every attribute.
+	user := ldap.NewEntry("uid=jane,ou=people,dc=example,dc=com", nil)
+	_, err = lc.identityFromEntry(*user)
+	if err == nil || !strings.Contains(err.Error(), "service account can read") {
+		t.Errorf("expected error about read permissions, got %v", err)
+	}
+
+	// The entry genuinely lacks an attribute.
+	user = ldap.NewEntry("uid=jane,ou=people,dc=example,dc=com", map[string][]string{
+		"uid": {"jane"},
+	})
+	_, err = lc.identityFromEntry(*user)
+	if err == nil || !strings.Contains(err.Error(), "missing following required attribute") {
+		t.Errorf("expected error about missing attributes, got %v", err)
+	}
+}
+
+func TestNameAttrFallback(t *testing.T) {
+	c := testConfig()
+	c.UserSearch.IDAttr = "uid"
+	c.UserSearch.EmailAttr = "mail"
+	c.UserSearch.NameAttr = StringList{"displayName", "cn"}
+	conn, err := c.OpenConnector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lc := conn.(*ldapConnector)
+
+	user := ldap.NewEntry("uid=jane,ou=people,dc=example,dc=com", map[string][]string{
+		"uid":         {"jane"},
+		"mail":        {"jane@example.com"},
+		"displayName": {""},
+		"cn":          {"Jane Doe"},
+	})
+	ident, err := lc.identityFromEntry(*user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ident.Username != "Jane Doe" {
+		t.Errorf("want=%q, got=%q", "Jane Doe", ident.Username)
+	}
+
+	user = ldap.NewEntry("uid=jane,ou=people,dc=example,dc=com", map[string][]string{
+		"uid":  {"jane"},
+		"mail": {"jane@example.com"},
+	})
+	if _, err := lc.identityFromEntry(*user); err == nil {
+		t.Errorf("expected error when no name candidate has a value")
+	}
+}
+
+func TestAttributeOptions(t *testing.T) {
+	c := testConfig()
+	c.UserSearch.IDAttr = "uid"
+	c.UserSearch.EmailAttr = "mail"
+	c.UserSearch.NameAttr = StringList{"displayName"}
+	conn, err := c.OpenConnector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lc := conn.(*ldapConnector)
+
+	tests := []struct {
+		name     string
+		nameAttr string
+		attrs    map[string][]string
+		want     string
+	}{
+		{
+			name:     "base form preferred",
+			nameAttr: "displayName",
+			attrs:    map[string][]string{"displayName": {"Jane"}, "displayName;lang-fr": {"Jeanne"}},
+			want:     "Jane",
+		},
+		{
+			name:     "tagged fallback",
+			nameAttr: "displayName",
+			attrs:    map[string][]string{"displayName;lang-fr": {"Jeanne"}, "displayName;lang-en": {"Jane"}},
+			want:     "Jane",
+		},
+		{
+			name:     "tagged fallback ignores case",
+			nameAttr: "displayname",
+			attrs:    map[string][]string{"displayName;lang-en": {"Jane"}},
+			want:     "Jane",
+		},
+		{
+			name:     "specific tag",
+			nameAttr: "displayName;lang-fr",
+			attrs:    map[string][]string{"displayName": {"Jane"}, "displayName;lang-fr": {"Jeanne"}},
+			want:     "Jeanne",
+		},
+		{
+			name:     "base form ignores case",
+			nameAttr: "displayname",
+			attrs:    map[string][]string{"displayName": {"Jane"}, "displayName;lang-de": {"Johanna"}},
+			want:     "Jane",
+		},
+	}
+	for _, test := range tests {
+		lc.UserSearch.NameAttr = StringList{test.nameAttr}
+		attrs := map[string][]string{"uid": {"jane"}, "mail": {"jane@example.com"}}
+		for name, values := range test.attrs {
+			attrs[name] = values
+		}
+		ident, err := lc.identityFromEntry(*ldap.NewEntry("uid=jane,ou=people,dc=example,dc=com", attrs))
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if ident.Username != test.want {
+			t.Errorf("%s: want=%q, got=%q", test.name, test.want, ident.Username)
+		}
+	}
+
+	// The user ID never comes from a tagged variant.
+	lc.UserSearch.IDAttr = "employeeNumber"
+	user := ldap.NewEntry("uid=jane,ou=people,dc=example,dc=com", map[string][]string{
+		"uid":                   {"jane"},
+		"mail":                  {"jane@example.com"},
+		"employeeNumber;binary": {"42"},
+	})
+	if ident, err := lc.identityFromEntry(*user); err == nil {
+		t.Errorf("expected error for entry with only a tagged idAttr, got user ID %q", ident.UserID)
+	}
+}
+
+func TestEachGroupPage(t *testing.T) {
+	addr, stop := fakeServer(t, func(req *ber.Packet, controls []ldap.Control) []fakeResponse {
+		paging, ok := ldap.FindControl(controls, ldap.ControlTypePaging).(*ldap.ControlPaging)
+		if !ok {
+			t.Errorf("expected paging control")
+			return []fakeResponse{{op: fakeResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultOperationsError)}}
+		}
+		if string(paging.Cookie) == "" {
+			return []fakeResponse{
+				{op: fakeEntry("cn=admins,ou=groups,dc=example,dc=com", map[string][]string{"cn": {"admins"}})},
+				{op: fakeEntry("cn=developers,ou=groups,dc=example,dc=com", map[string][]string{"cn": {"developers"}})},
+				{
+					op:       fakeResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess),
+					controls: []ldap.Control{&ldap.ControlPaging{PagingSize: 2, Cookie: []byte("page2")}},
+				},
+			}
+		}
+		return []fakeResponse{
+			{op: fakeEntry("cn=admins,ou=groups,dc=example,dc=com", map[string][]string{"cn": {"admins"}})},
+			{
+				op:       fakeResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess),
+				controls: []ldap.Control{&ldap.ControlPaging{PagingSize: 2}},
+			},
+		}
+	})
+	defer stop()
+
+	c := testConfig()
+	c.Host = addr
+	c.InsecureNoSSL = true
+	c.GroupSearch.BaseDN = "ou=groups,dc=example,dc=com"
+	c.GroupSearch.UserAttr = "uid"
+	c.GroupSearch.GroupAttr = "memberUid"
+	c.GroupSearch.NameAttr = "cn"
+	c.GroupSearch.PageSize = 2
+	conn, err := c.OpenConnector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lc := conn.(*ldapConnector)
+	user := ldap.NewEntry("uid=jane,ou=people,dc=example,dc=com", map[string][]string{"uid": {"jane"}})
+
+	var pages [][]string
+	err = lc.eachGroupPage(context.Background(), *user, func(groups []Group) error {
+		var names []string
+		for _, g := range groups {
+			names = append(names, g.Name)
+		}
+		pages = append(pages, names)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantPages := [][]string{{"admins", "developers"}, {"admins"}}
+	if !reflect.DeepEqual(pages, wantPages) {
+		t.Errorf("want=%q, got=%q", wantPages, pages)
+	}
+
+	groups, err := lc.groups(context.Background(), *user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"admins", "developers"}; !reflect.DeepEqual(groups, want) {
+		t.Errorf("want=%q, got=%q", want, groups)
+	}
+}
+
+func TestEachGroupPageNoRetry(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		searches int
+	)
+	addr, stop := fakeServer(t, func(req *ber.Packet, controls []ldap.Control) []fakeResponse {
+		mu.Lock()
+		searches++
+		mu.Unlock()
+		return []fakeResponse{
+			{op: fakeEntry("cn=admins,ou=groups,dc=example,dc=com", map[string][]string{"cn": {"admins"}})},
+			{
+				op:       fakeResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess),
+				controls: []ldap.Control{&ldap.ControlPaging{PagingSize: 1, Cookie: []byte("next")}},
+			},
+		}
+	})
+	defer stop()
+
+	c := testConfig()
+	c.Host = addr
+	c.InsecureNoSSL = true
+	c.PersistentConnection = true
+	c.GroupSearch.BaseDN = "ou=groups,dc=example,dc=com"
+	c.GroupSearch.UserAttr = "uid"
+	c.GroupSearch.GroupAttr = "memberUid"
+	c.GroupSearch.NameAttr = "cn"
+	c.GroupSearch.PageSize = 1
+	conn, err := c.OpenConnector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	lc := conn.(*ldapConnector)
+	user := ldap.NewEntry("uid=jane,ou=people,dc=example,dc=com", map[string][]string{"uid": {"jane"}})
+
+	pages := 0
+	err = lc.eachGroupPage(context.Background(), *user, func(groups []Group) error {
+		pages++
+		// The connection drops after the first page.
+		lc.mu.Lock()
+		lc.persistentConn.Close()
+		lc.mu.Unlock()
+		return nil
+	})
+	if err == nil {
+		t.Fatal("expected the group search to fail")
+	}
+	if isStaleConnection(err) {
+		t.Errorf("expected the error not to be retried, got %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if pages != 1 || searches != 1 {
+		t.Errorf("expected 1 page from 1 search, got %d pages from %d searches", pages, searches)
+	}
+}
+
+func TestConnectorDataRawGroups(t *testing.T) {
+	var (
+		mu           sync.Mutex
+		groupQueries int
+	)
+	addr, stop := fakeServer(t, func(req *ber.Packet, controls []ldap.Control) []fakeResponse {
+		if baseDN, _ := req.Children[0].Value.(string); baseDN == "ou=groups,dc=example,dc=com" {
+			mu.Lock()
+			groupQueries++
+			swap := groupQueries%2 == 0
+			mu.Unlock()
+			// Return the groups in a different order each time.
+			groups := []string{"ldap-engineers", "ldap-admins"}
+			if swap {
+				groups[0], groups[1] = groups[1], groups[0]
+			}
+			var resps []fakeResponse
+			for _, name := range groups {
+				resps = append(resps, fakeResponse{op: fakeEntry("cn="+name+",ou=groups,dc=example,dc=com", map[string][]string{"cn": {name}})})
+			}
+			return append(resps, fakeResponse{op: fakeResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)})
+		}
+		return []fakeResponse{
+			{op: fakeEntry("uid=jane,ou=people,dc=example,dc=com", map[string][]string{"uid": {"jane"}, "mail": {"jane@example.com"}})},
+			{op: fakeResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)},
+		}
+	})
+	defer stop()
+
+	c := testConfig()
+	c.Host = addr
+	c.InsecureNoSSL = true
+	c.UserSearch.IDAttr = "uid"
+	c.UserSearch.EmailAttr = "mail"
+	c.GroupSearch.BaseDN = "ou=groups,dc=example,dc=com"
+	c.GroupSearch.UserAttr = "uid"
+	c.GroupSearch.GroupAttr = "memberUid"
+	c.GroupSearch.NameAttr = "cn"
+	c.GroupSearch.RoleMapping = map[string]string{"ldap-admins": "admin"}
+	c.GroupSearch.DropUnmappedGroups = true
+	c.GroupSearch.ExposeRawGroups = true
+	conn, err := c.OpenConnector()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := connector.Scopes{OfflineAccess: true, Groups: true}
+	ident, valid, err := conn.Login(context.Background(), s, "jane", "secret")
+	if err != nil || !valid {
+		t.Fatalf("expected valid login, got valid=%t err=%v", valid, err)
+	}
+	if want := []string{"admin"}; !reflect.DeepEqual(ident.Groups, want) {
+		t.Errorf("want mapped groups claim %q, got %q", want, ident.Groups)
+	}
+	var data ConnectorData
+	if err := json.Unmarshal(ident.ConnectorData, &data); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"ldap-admins", "ldap-engineers"}; !reflect.DeepEqual(data.RawGroups, want) {
+		t.Errorf("want raw groups %q, got %q", want, data.RawGroups)
+	}
+
+	refreshed, err := conn.Refresh(context.Background(), s, ident)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	if groupQueries != 2 {
+		t.Errorf("expected groups to be queried again on refresh, got %d queries", groupQueries)
+	}
+	mu.Unlock()
+	if !reflect.DeepEqual(refreshed, ident) {
+		t.Errorf("expected refresh to return the login identity %+v, got %+v", ident, refreshed)
+	}
+
+	ident, valid, err = conn.Login(context.Background(), connector.Scopes{OfflineAccess: true}, "jane", "secret")
+	if err != nil || !valid {
+		t.Fatalf("expected valid login, got valid=%t err=%v", valid, err)
+	}
+	data = ConnectorData{}
+	if err := json.Unmarshal(ident.ConnectorData, &data); err != nil {
+		t.Fatal(err)
+	}
+	if data.RawGroups != nil {
+		t.Errorf("expected no raw groups without the groups scope, got %q", data.RawGroups)
+	}
+
+	c = testConfig()
+	c.GroupSearch.ExposeRawGroups = true
+	if _, err := c.OpenConnector(); err == nil {
+		t.Errorf("expected exposeRawGroups without a group search to be rejected")
+	}
+}
+
+func TestAdminRole(t *testing.T) {
+	c := testConfig()
+	c.GroupSearch.BaseDN = "ou=groups,dc=example,dc=com"
+	c.GroupSearch.UserAttr = "uid"
+	c.GroupSearch.GroupAttr = "memberUid"
+	c.GroupSearch.NameAttr = "cn"
+	c.GroupSearch.AdminGroups = []string{"admins", "operators"}
+	c.GroupSearch.AdminRole = "dex-admin"
+	c.GroupSearch.MaxGroups = 1
+	conn, err := c.OpenConnector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lc := conn.(*ldapConnector)
+	dn := "uid=jane,ou=people,dc=example,dc=com"
+
+	// The role is kept over the user's other groups.
+	if got, want := lc.groupClaims(context.Background(), dn, []string{"developers", "operators"}), []string{"dex-admin"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("want=%q, got=%q", want, got)
+	}
+	if got, want := lc.groupClaims(context.Background(), dn, []string{"developers"}), []string{"developers"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("want=%q, got=%q", want, got)
+	}
+
+	c.GroupSearch.AdminRole = ""
+	if _, err := c.OpenConnector(); err == nil {
+		t.Errorf("expected error for adminGroups without adminRole")
+	}
+}
+
+func TestRequiredGroupsWithoutGroupsScope(t *testing.T) {
+	var filters []string
+	addr, stop := fakeServer(t, func(req *ber.Packet, controls []ldap.Control) []fakeResponse {
+		filter, err := ldap.DecompileFilter(req.Children[6])
+		if err != nil {
+			t.Errorf("decompile filter: %v", err)
+		}
+		filters = append(filters, filter)
+		if strings.Contains(filter, "(cn=admins)") {
+			return []fakeResponse{
+				{op: fakeEntry("cn=admins,ou=groups,dc=example,dc=com", nil)},
+				{op: fakeResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)},
+			}
+		}
+		return []fakeResponse{{op: fakeResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)}}
+	})
+	defer stop()
+
+	c := testConfig()
+	c.Host = addr
+	c.InsecureNoSSL = true
+	c.GroupSearch.BaseDN = "ou=groups,dc=example,dc=com"
+	c.GroupSearch.UserAttr = "uid"
+	c.GroupSearch.GroupAttr = "memberUid"
+	c.GroupSearch.NameAttr = "cn"
+	c.GroupSearch.RequiredGroups = []string{"admins", "ops*"}
+	conn, err := c.OpenConnector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lc := conn.(*ldapConnector)
+	user := ldap.NewEntry("uid=jane,ou=people,dc=example,dc=com", map[string][]string{"uid": {"jane"}})
+
+	groups, err := lc.userGroups(context.Background(), connector.Scopes{}, *user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if groups != nil {
+		t.Errorf("expected no groups without the groups scope, got %q", groups)
+	}
+	wantFilters := []string{`(&(memberUid=jane)(|(cn=admins)(cn=ops\2a)))`}
+	if !reflect.DeepEqual(filters, wantFilters) {
+		t.Errorf("want=%q, got=%q", wantFilters, filters)
+	}
+
+	lc.GroupSearch.RequiredGroups = []string{"operators"}
+	_, err = lc.userGroups(context.Background(), connector.Scopes{}, *user)
+	if _, ok := err.(*notMemberError); !ok {
+		t.Errorf("expected *notMemberError, got %v", err)
+	}
+}
+
+func TestRequiredGroupsLoginAndRefresh(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		member = true
+	)
+	addr, stop := fakeServer(t, func(req *ber.Packet, controls []ldap.Control) []fakeResponse {
+		if baseDN, _ := req.Children[0].Value.(string); baseDN == "ou=groups,dc=example,dc=com" {
+			mu.Lock()
+			defer mu.Unlock()
+			if !member {
+				return []fakeResponse{{op: fakeResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)}}
+			}
+			return []fakeResponse{
+				{op: fakeEntry("cn=vpn-users,ou=groups,dc=example,dc=com", map[string][]string{"cn": {"vpn-users"}})},
+				{op: fakeResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)},
+			}
+		}
+		return []fakeResponse{
+			{op: fakeEntry("uid=jane,ou=people,dc=example,dc=com", map[string][]string{"uid": {"jane"}, "mail": {"jane@example.com"}})},
+			{op: fakeResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)},
+		}
+	})
+	defer stop()
+
+	c := testConfig()
+	c.Host = addr
+	c.InsecureNoSSL = true
+	c.UserSearch.IDAttr = "uid"
+	c.UserSearch.EmailAttr = "mail"
+	c.GroupSearch.BaseDN = "ou=groups,dc=example,dc=com"
+	c.GroupSearch.UserAttr = "uid"
+	c.GroupSearch.GroupAttr = "memberUid"
+	c.GroupSearch.NameAttr = "cn"
+	c.GroupSearch.RequiredGroups = []string{"vpn-users"}
+	conn, err := c.OpenConnector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	s := connector.Scopes{OfflineAccess: true, Groups: true}
+	ident, valid, err := conn.Login(context.Background(), s, "jane", "password")
+	if err != nil || !valid {
+		t.Fatalf("expected member to log in, got valid=%t err=%v", valid, err)
+	}
+	if _, err := conn.Refresh(context.Background(), s, ident); err != nil {
+		t.Errorf("expected member to refresh: %v", err)
+	}
+
+	mu.Lock()
+	member = false
+	mu.Unlock()
+	if _, err := conn.Refresh(context.Background(), s, ident); err == nil {
+		t.Errorf("expected refresh to fail once the user left the required group")
+	}
+	if _, valid, err := conn.Login(context.Background(), s, "jane", "password"); err != nil || valid {
+		t.Errorf("expected non-member login to be refused, got valid=%t err=%v", valid, err)
+	}
+}
+
+func TestResolvePassword(t *testing.T) {
+	f, err := ioutil.TempFile("", "dex-ldap-bindpw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString("secret\n"); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	empty, err := ioutil.TempFile("", "dex-ldap-bindpw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(empty.Name())
+	empty.Close()
+
+	os.Setenv("DEX_LDAP_TEST_BINDPW", "fromenv")
+	defer os.Unsetenv("DEX_LDAP_TEST_BINDPW")
+
+	tests := []struct {
+		name          string
+		pw, file, env string
+		want          string
+		wantErr       bool
+	}{
+		{name: "inline", pw: "inline", want: "inline"},
+		{name: "file", file: f.Name(), want: "secret"},
+		{name: "env", env: "DEX_LDAP_TEST_BINDPW", want: "fromenv"},
+		{name: "empty file", file: empty.Name(), wantErr: true},
+		{name: "missing file", file: f.Name() + ".missing", wantErr: true},
+		{name: "unset env", env: "DEX_LDAP_TEST_UNSET", wantErr: true},
+		{name: "both", pw: "inline", env: "DEX_LDAP_TEST_BINDPW", wantErr: true},
+	}
+	for _, test := range tests {
+		got, err := resolvePassword("", test.pw, test.file, test.env)
+		if err != nil {
+			if !test.wantErr {
+				t.Errorf("%s: %v", test.name, err)
+			}
+			continue
+		}
+		if test.wantErr {
+			t.Errorf("%s: expected error", test.name)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%s: want=%q, got=%q", test.name, test.want, got)
+		}
+	}
+
+	c := testConfig()
+	c.GroupSearch.BaseDN = "ou=groups,dc=example,dc=com"
+	c.GroupSearch.UserAttr = "uid"
+	c.GroupSearch.GroupAttr = "memberUid"
+	c.GroupSearch.NameAttr = "cn"
+	c.GroupSearch.BindPWEnv = "DEX_LDAP_TEST_BINDPW"
+	if _, err := c.OpenConnector(); err == nil {
+		t.Errorf("expected error for groupSearch.bindPWEnv without groupSearch.bindDN")
+	}
+	c.GroupSearch.BindDN = "uid=groupreader,ou=people,dc=example,dc=com"
+	conn, err := c.OpenConnector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := conn.(*ldapConnector).GroupSearch.BindPW; got != "fromenv" {
+		t.Errorf("expected the group search password from the environment, got %q", got)
+	}
+	if c.GroupSearch.BindPW != "" {
+		t.Errorf("expected the config not to hold the resolved password")
+	}
+}
+
+func TestNormalizeEmail(t *testing.T) {
+	c := testConfig()
+	c.UserSearch.IDAttr = "uid"
+	c.UserSearch.EmailAttr = "proxyAddresses"
+	c.UserSearch.NormalizeEmail = true
+	c.UserSearch.StrictEmail = true
+	c.UserSearch.EmailSelect = "primarySMTP"
+	conn, err := c.OpenConnector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lc := conn.(*ldapConnector)
+
+	tests := []struct {
+		name    string
+		values  []string
+		want    string
+		wantErr bool
+	}{
+		{name: "whitespace and case", values: []string{"  SMTP: Jane@Example.COM "}, want: "jane@example.com"},
+		{
+			name:   "primary address",
+			values: []string{"smtp:jane.doe@example.com", "SMTP:Jane@example.com", "x500:/o=Example"},
+			want:   "jane@example.com",
+		},
+		{name: "aliases only", values: []string{"smtp:a@example.com", "smtp:b@example.com"}, wantErr: true},
+		{name: "display name", values: []string{"SMTP:Jane <jane@example.com>"}, wantErr: true},
+	}
+	for _, test := range tests {
+		user := ldap.NewEntry("uid=jane,ou=people,dc=example,dc=com", map[string][]string{
+			"uid":            {"jane"},
+			"proxyAddresses": test.values,
+		})
+		ident, err := lc.identityFromEntry(*user)
+		if err != nil {
+			if !test.wantErr {
+				t.Errorf("%s: %v", test.name, err)
+			}
+			continue
+		}
+		if test.wantErr {
+			t.Errorf("%s: expected error, got email %q", test.name, ident.Email)
+			continue
+		}
+		if ident.Email != test.want {
+			t.Errorf("%s: want=%q, got=%q", test.name, test.want, ident.Email)
+		}
+	}
+
+	// Without emailSelect the first value is normalized.
+	c.UserSearch.EmailSelect = ""
+	conn, err = c.OpenConnector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := ldap.NewEntry("uid=jane,ou=people,dc=example,dc=com", map[string][]string{
+		"uid":            {"jane"},
+		"proxyAddresses": {"smtp:Jane.Doe@example.com", "SMTP:jane@example.com"},
+	})
+	ident, err := conn.(*ldapConnector).identityFromEntry(*user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "jane.doe@example.com"; ident.Email != want {
+		t.Errorf("want=%q, got=%q", want, ident.Email)
+	}
+}
+
+func TestWrapKind(t *testing.T) {
+	cause := ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("bad password"))
+	err := wrapKind(ErrServiceBind, cause, `as "cn=admin"`)
+	if !errors.Is(err, ErrServiceBind) || errors.Is(err, ErrDial) {
+		t.Errorf("expected only ErrServiceBind to match, got %v", err)
+	}
+	var ldapErr *ldap.Error
+	if !errors.As(err, &ldapErr) || ldapErr != cause {
+		t.Errorf("expected the cause to be wrapped")
+	}
+	if want := `ldap: initial bind failed: as "cn=admin": ` + cause.Error(); err.Error() != want {
+		t.Errorf("want=%q, got=%q", want, err.Error())
+	}
+
+	err = wrapKind(ErrDial, ErrCircuitOpen, "")
+	if !errors.Is(err, ErrDial) || !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("expected both ErrDial and ErrCircuitOpen to match, got %v", err)
+	}
+}
+
+func TestErrorTypes(t *testing.T) {
+	// A port that nothing listens on.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedAddr := l.Addr().String()
+	l.Close()
+
+	c := testConfig()
+	c.Host = closedAddr
+	c.InsecureNoSSL = true
+	conn, err := c.OpenConnector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = conn.(*ldapConnector).do(context.Background(), func(*ldap.Conn) error { return nil })
+	if !errors.Is(err, ErrDial) || !isNetworkError(err) {
+		t.Errorf("expected ErrDial wrapping a network error, got %v", err)
+	}
+
+	// A server that rejects every bind.
+	l, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			packet, err := ber.ReadPacket(conn)
+			if err == nil && len(packet.Children) >= 2 {
+				resp := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+				resp.AppendChild(packet.Children[0])
+				resp.AppendChild(fakeResult(ldap.ApplicationBindResponse, ldap.LDAPResultInvalidCredentials))
+				conn.Write(resp.Bytes())
+			}
+			conn.Close()
+		}
+	}()
+
+	c = testConfig()
+	c.Host = l.Addr().String()
+	c.InsecureNoSSL = true
+	c.AnonymousBind = false
+	c.BindDN = "cn=admin,dc=example,dc=com"
+	c.BindPW = "wrong"
+	conn, err = c.OpenConnector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = conn.(*ldapConnector).do(context.Background(), func(*ldap.Conn) error { return nil })
+	if !errors.Is(err, ErrServiceBind) || !isResultCode(err, ldap.LDAPResultInvalidCredentials) {
+		t.Errorf("expected ErrServiceBind wrapping invalid credentials, got %v", err)
+	}
+	if errors.Is(err, ErrDial) {
+		t.Errorf("expected a failed bind not to be reported as ErrDial")
+	}
+
+	// A user that no longer exists.
+	addr, stop := fakeServer(t, func(req *ber.Packet, controls []ldap.Control) []fakeResponse {
+		return []fakeResponse{{op: fakeResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)}}
+	})
+	defer stop()
+
+	c = testConfig()
+	c.Host = addr
+	c.InsecureNoSSL = true
+	conn, err = c.OpenConnector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(ConnectorData{Username: "jane"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = conn.Refresh(context.Background(), connector.Scopes{}, connector.Identity{ConnectorData: data})
+	if !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("expected ErrUserNotFound, got %v", err)
+	}
+}
+
+func TestEmailSelectPrimarySMTP(t *testing.T) {
+	c := testConfig()
+	c.UserSearch.IDAttr = "uid"
+	c.UserSearch.EmailAttr = "proxyAddresses"
+	c.UserSearch.EmailSelect = "primarySMTP"
+	conn, err := c.OpenConnector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lc := conn.(*ldapConnector)
+
+	user := ldap.NewEntry("uid=jane,ou=people,dc=example,dc=com", map[string][]string{
+		"uid":            {"jane"},
+		"proxyAddresses": {"smtp:jane.doe@example.com", "SMTP:Jane@example.com", "x500:/o=Example"},
+	})
+	ident, err := lc.identityFromEntry(*user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "Jane@example.com"; ident.Email != want {
+		t.Errorf("want=%q, got=%q", want, ident.Email)
+	}
+
+	// Aliases alone don't count as an email.
+	user = ldap.NewEntry("uid=jane,ou=people,dc=example,dc=com", map[string][]string{
+		"uid":            {"jane"},
+		"proxyAddresses": {"smtp:jane.doe@example.com"},
+	})
+	if _, err := lc.identityFromEntry(*user); err == nil {
+		t.Errorf("expected error for entry without a primary address")
+	}
+
+	c.UserSearch.EmailSelect = "last"
+	if _, err := c.OpenConnector(); err == nil {
+		t.Errorf("expected error for unknown emailSelect")
+	}
+}
+
+func TestGroupSearchBindDN(t *testing.T) {
+	var mu sync.Mutex
+	bound := map[string]string{}
+	addr, stop := fakeServerBound(t, func(boundDN string, req *ber.Packet, controls []ldap.Control) []fakeResponse {
+		baseDN, _ := req.Children[0].Value.(string)
+		mu.Lock()
+		bound[baseDN] = boundDN
+		mu.Unlock()
+		if baseDN == "ou=people,dc=example,dc=com" {
+			return []fakeResponse{
+				{op: fakeEntry("uid=jane,ou=people,dc=example,dc=com", map[string][]string{"uid": {"jane"}, "mail": {"jane@example.com"}})},
+				{op: fakeResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)},
+			}
+		}
+		return []fakeResponse{
+			{op: fakeEntry("cn=admins,ou=groups,dc=example,dc=com", map[string][]string{"cn": {"admins"}})},
+			{op: fakeResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)},
+		}
+	})
+	defer stop()
+
+	c := testConfig()
+	c.Host = addr
+	c.InsecureNoSSL = true
+	c.AnonymousBind = false
+	c.BindDN = "cn=svc,dc=example,dc=com"
+	c.PersistentConnection = true
+	c.UserSearch.IDAttr = "uid"
+	c.UserSearch.EmailAttr = "mail"
+	c.GroupSearch.BaseDN = "ou=groups,dc=example,dc=com"
+	c.GroupSearch.UserAttr = "uid"
+	c.GroupSearch.GroupAttr = "memberUid"
+	c.GroupSearch.NameAttr = "cn"
+	c.GroupSearch.BindDN = "cn=groupreader,dc=example,dc=com"
+	c.GroupSearch.BindPW = "secret"
+	conn, err := c.OpenConnector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	for i := 0; i < 2; i++ {
+		ident, valid, err := conn.Login(context.Background(), connector.Scopes{Groups: true}, "jane", "password")
+		if err != nil || !valid {
+			t.Fatalf("login failed: valid=%t err=%v", valid, err)
+		}
+		if want := []string{"admins"}; !reflect.DeepEqual(ident.Groups, want) {
+			t.Errorf("want=%q, got=%q", want, ident.Groups)
+		}
+		mu.Lock()
+		want := map[string]string{
+			"ou=people,dc=example,dc=com": "cn=svc,dc=example,dc=com",
+			"ou=groups,dc=example,dc=com": "cn=groupreader,dc=example,dc=com",
+		}
+		if !reflect.DeepEqual(bound, want) {
+			t.Errorf("login %d: want searches bound as %q, got %q", i, want, bound)
+		}
+		mu.Unlock()
+	}
+
+	c.GroupSearch.BindDN = ""
+	if _, err := c.OpenConnector(); err == nil {
+		t.Errorf("expected error for groupSearch.bindPW without groupSearch.bindDN")
+	}
+}
+
+func TestGroupSearchAsUser(t *testing.T) {
+	const userDN = "uid=jane,ou=people,dc=example,dc=com"
+	addr, stop := fakeServerBound(t, func(boundDN string, req *ber.Packet, controls []ldap.Control) []fakeResponse {
+		baseDN, _ := req.Children[0].Value.(string)
+		if baseDN == "ou=people,dc=example,dc=com" {
+			return []fakeResponse{
+				{op: fakeEntry(userDN, map[string][]string{"uid": {"jane"}, "mail": {"jane@example.com"}})},
+				{op: fakeResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)},
+			}
+		}
+		if boundDN != userDN {
+			// Only the user may read their memberships.
+			return []fakeResponse{{op: fakeResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)}}
+		}
+		return []fakeResponse{
+			{op: fakeEntry("cn=admins,ou=groups,dc=example,dc=com", map[string][]string{"cn": {"admins"}})},
+			{op: fakeResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)},
+		}
+	})
+	defer stop()
+
+	for _, persistent := range []bool{false, true} {
+		c := testConfig()
+		c.Host = addr
+		c.InsecureNoSSL = true
+		c.AnonymousBind = false
+		c.BindDN = "cn=svc,dc=example,dc=com"
+		c.PersistentConnection = persistent
+		c.UserSearch.IDAttr = "uid"
+		c.UserSearch.EmailAttr = "mail"
+		c.GroupSearch.BaseDN = "ou=groups,dc=example,dc=com"
+		c.GroupSearch.UserAttr = "uid"
+		c.GroupSearch.GroupAttr = "memberUid"
+		c.GroupSearch.NameAttr = "cn"
+		c.GroupSearch.AsUser = true
+		conn, err := c.OpenConnector()
+		if err != nil {
+			t.Fatal(err)
+		}
+		lc := conn.(*ldapConnector)
+
+		s := connector.Scopes{Groups: true, OfflineAccess: true}
+		ident, valid, err := lc.Login(context.Background(), s, "jane", "password")
+		if err != nil || !valid {
+			t.Fatalf("persistent=%t: login failed: valid=%t err=%v", persistent, valid, err)
+		}
+		if want := []string{"admins"}; !reflect.DeepEqual(ident.Groups, want) {
+			t.Errorf("persistent=%t: want groups %q, got %q", persistent, want, ident.Groups)
+		}
+
+		// Refreshes can't bind as the user, and keep the groups found at login.
+		ident, err = lc.Refresh(context.Background(), s, ident)
+		if err != nil {
+			t.Fatalf("persistent=%t: refresh: %v", persistent, err)
+		}
+		if want := []string{"admins"}; !reflect.DeepEqual(ident.Groups, want) {
+			t.Errorf("persistent=%t: want refreshed groups %q, got %q", persistent, want, ident.Groups)
+		}
+		conn.Close()
+	}
+
+	c := testConfig()
+	c.GroupSearch.BaseDN = "ou=groups,dc=example,dc=com"
+	c.GroupSearch.UserAttr = "uid"
+	c.GroupSearch.GroupAttr = "memberUid"
+	c.GroupSearch.NameAttr = "cn"
+	c.GroupSearch.AsUser = true
+	c.GroupSearch.BindDN = "cn=groupreader,dc=example,dc=com"
+	if _, err := c.OpenConnector(); err == nil {
+		t.Errorf("expected error for groupSearch.asUser with groupSearch.bindDN")
+	}
+
+	// Membership checks would go stale as refreshes reuse the login's groups.
+	c.GroupSearch.BindDN = ""
+	c.GroupSearch.RequiredGroups = []string{"vpn-users"}
+	if _, err := c.OpenConnector(); err == nil {
+		t.Errorf("expected error for groupSearch.asUser with groupSearch.requiredGroups")
+	}
+	c.GroupSearch.RequiredGroups = nil
+	c.GroupSearch.AdminGroups = []string{"admins"}
+	c.GroupSearch.AdminRole = "admin"
+	if _, err := c.OpenConnector(); err == nil {
+		t.Errorf("expected error for groupSearch.asUser with groupSearch.adminGroups")
+	}
+}
+
+func TestInsecureSkipHostnameVerify(t *testing.T) {
+	caPEM, cert := testCertificates(t, "ldap.example.com")
+	otherCAPEM, _ := testCertificates(t, "ldap.example.com")
+	addr, stop := tlsServer(t, cert)
+	defer stop()
+
+	tests := []struct {
+		name         string
+		rootCA       []byte
+		skipHostname bool
+		wantErr      bool
+	}{
+		{name: "hostname mismatch", rootCA: caPEM, wantErr: true},
+		{name: "skip hostname", rootCA: caPEM, skipHostname: true},
+		{name: "skip hostname with untrusted CA", rootCA: otherCAPEM, skipHostname: true, wantErr: true},
+	}
+	for _, test := range tests {
+		c := testConfig()
+		c.Host = addr
+		c.RootCAData = test.rootCA
+		c.InsecureSkipHostnameVerify = test.skipHostname
+		conn, err := c.OpenConnector()
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		ldapConn, err := conn.(*ldapConnector).connectAny(context.Background(), false)
+		if err != nil {
+			if !test.wantErr {
+				t.Errorf("%s: %v", test.name, err)
+			}
+			continue
+		}
+		ldapConn.Close()
+		if test.wantErr {
+			t.Errorf("%s: expected error", test.name)
+		}
+	}
+
+	c := testConfig()
+	c.InsecureSkipVerify = true
+	c.InsecureSkipHostnameVerify = true
+	if _, err := c.OpenConnector(); err == nil {
+		t.Errorf("expected error when both options are set")
+	}
+}
+
+func TestRootCAData(t *testing.T) {
+	caPEM, _ := testCertificates(t, "ldap.example.com")
+	encoded := base64.StdEncoding.EncodeToString(caPEM)
+
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr bool
+	}{
+		{name: "pem", data: caPEM},
+		{name: "base64", data: []byte(encoded)},
+		{name: "wrapped base64", data: []byte(encoded[:64] + "\n" + encoded[64:] + "\n")},
+		{name: "invalid base64", data: []byte("not base64!"), wantErr: true},
+		{name: "base64 without pem", data: []byte(base64.StdEncoding.EncodeToString([]byte("hello"))), wantErr: true},
+	}
+	for _, test := range tests {
+		c := testConfig()
+		c.RootCAData = test.data
+		_, err := c.OpenConnector()
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%s: expected error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+	}
+}
+
+func TestRootCADirectory(t *testing.T) {
+	caPEM, cert := testCertificates(t, "ldap.example.com")
+	addr, stop := tlsServer(t, cert)
+	defer stop()
+
+	dir, err := ioutil.TempDir("", "dex-ldap-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"ca.crt":       string(caPEM),
+		"README.txt":   "not a certificate",
+		"broken.pem":   "not a certificate",
+		".hidden.pem":  "not a certificate",
+		"..data/x.pem": "not a certificate",
+	}
+	for name, content := range files {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := testConfig()
+	c.Host = addr
+	c.RootCA = dir
+	c.InsecureSkipHostnameVerify = true
+	var buf bytes.Buffer
+	conn, err := c.OpenConnector(WithLogger(log.New(&buf, "", 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ldapConn, err := conn.(*ldapConnector).connectAny(context.Background(), false)
+	if err != nil {
+		t.Fatalf("expected the CA in the directory to be trusted: %v", err)
+	}
+	ldapConn.Close()
+
+	logs := buf.String()
+	for _, skipped := range []string{"README.txt", "broken.pem"} {
+		if !strings.Contains(logs, skipped) {
+			t.Errorf("expected a warning about %q, got %q", skipped, logs)
+		}
+	}
+	if strings.Contains(logs, "hidden") || strings.Contains(logs, "..data") {
+		t.Errorf("expected hidden entries to be skipped silently, got %q", logs)
+	}
+
+	empty, err := ioutil.TempDir("", "dex-ldap-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(empty)
+	c.RootCA = empty
+	if _, err := c.OpenConnector(); err == nil {
+		t.Errorf("expected error for a directory without certs")
+	}
+}
+
+func TestGroupClaimsRoleMapping(t *testing.T) {
+	c := testConfig()
+	c.GroupSearch.BaseDN = "ou=groups,dc=example,dc=com"
+	c.GroupSearch.UserAttr = "uid"
+	c.GroupSearch.GroupAttr = "memberUid"
+	c.GroupSearch.NameAttr = "cn"
+	c.GroupSearch.RoleMapping = map[string]string{
+		"ldap-admins":    "admin",
+		"domain-admins":  "admin",
+		"ldap-engineers": "developer",
+	}
+	conn, err := c.OpenConnector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lc := conn.(*ldapConnector)
+
+	groups := []string{"ldap-engineers", "domain-admins", "ldap-admins", "vpn-users"}
+	if got, want := lc.groupClaims(context.Background(), "uid=jane,ou=people,dc=example,dc=com", groups), []string{"admin", "developer", "vpn-users"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("want=%q, got=%q", want, got)
+	}
+
+	lc.GroupSearch.DropUnmappedGroups = true
+	if got, want := lc.groupClaims(context.Background(), "uid=jane,ou=people,dc=example,dc=com", groups), []string{"admin", "developer"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("want=%q, got=%q", want, got)
+	}
+
+	c.GroupSearch.RoleMapping = nil
+	c.GroupSearch.DropUnmappedGroups = true
+	if _, err := c.OpenConnector(); err == nil {
+		t.Errorf("expected error for dropUnmappedGroups without roleMapping")
+	}
+}
+
+func TestPrimaryGroup(t *testing.T) {
+	// S-1-5-21-1-2-3-1104 and its primary group S-1-5-21-1-2-3-513.
+	userSID := []byte{1, 5, 0, 0, 0, 0, 0, 5, 21, 0, 0, 0, 1, 0, 0, 0, 2, 0, 0, 0, 3, 0, 0, 0, 0x50, 0x04, 0, 0}
+	groupSID := []byte{1, 5, 0, 0, 0, 0, 0, 5, 21, 0, 0, 0, 1, 0, 0, 0, 2, 0, 0, 0, 3, 0, 0, 0, 0x01, 0x02, 0, 0}
+
+	addr, stop := fakeServer(t, func(req *ber.Packet, controls []ldap.Control) []fakeResponse {
+		filter := req.Children[6]
+		done := fakeResponse{op: fakeResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)}
+		if filter.Tag == ldap.FilterEqualityMatch {
+			attr, _ := filter.Children[0].Value.(string)
+			value := filter.Children[1].Data.Bytes()
+			switch {
+			case attr == "gidNumber" && string(value) == "1000":
+				return []fakeResponse{{op: fakeEntry("cn=users,ou=groups,dc=example,dc=com", map[string][]string{"cn": {"users"}})}, done}
+			case attr == "objectSid" && bytes.Equal(value, groupSID):
+				return []fakeResponse{{op: fakeEntry("cn=Domain Users,ou=groups,dc=example,dc=com", map[string][]string{"cn": {"Domain Users"}})}, done}
+			case attr == "memberUid":
+				return []fakeResponse{{op: fakeEntry("cn=admins,ou=groups,dc=example,dc=com", map[string][]string{"cn": {"admins"}})}, done}
+			}
+			t.Errorf("unexpected filter on %q: %x", attr, value)
+		}
+		return []fakeResponse{done}
+	})
+	defer stop()
+
+	tests := []struct {
+		primaryGroup string
+		attrs        map[string][]string
+		want         []string
+	}{
+		{
+			primaryGroup: "posix",
+			attrs:        map[string][]string{"uid": {"jane"}, "gidNumber": {"1000"}},
+			want:         []string{"admins", "users"},
+		},
+		{
+			primaryGroup: "ad",
+			attrs:        map[string][]string{"uid": {"jane"}, "objectSid": {string(userSID)}, "primaryGroupID": {"513"}},
+			want:         []string{"Domain Users", "admins"},
+		},
+		{
+			// The primary group is still returned without other memberships.
+			primaryGroup: "posix",
+			attrs:        map[string][]string{"gidNumber": {"1000"}},
+			want:         []string{"users"},
+		},
+	}
+	for _, test := range tests {
+		c := testConfig()
+		c.Host = addr
+		c.InsecureNoSSL = true
+		c.GroupSearch.BaseDN = "ou=groups,dc=example,dc=com"
+		c.GroupSearch.UserAttr = "uid"
+		c.GroupSearch.GroupAttr = "memberUid"
+		c.GroupSearch.NameAttr = "cn"
+		c.GroupSearch.FailOnEmpty = true
+		c.GroupSearch.PrimaryGroup = test.primaryGroup
+		conn, err := c.OpenConnector()
+		if err != nil {
+			t.Fatal(err)
+		}
+		user := ldap.NewEntry("uid=jane,ou=people,dc=example,dc=com", test.attrs)
+		groups, err := conn.(*ldapConnector).groups(context.Background(), *user)
+		if err != nil {
+			t.Errorf("%s: %v", test.primaryGroup, err)
+			continue
+		}
+		if !reflect.DeepEqual(groups, test.want) {
+			t.Errorf("%s: want=%q, got=%q", test.primaryGroup, test.want, groups)
+		}
+	}
+
+	if _, err := primaryGroupSID(userSID[:10], "513"); err == nil {
+		t.Errorf("expected error for truncated SID")
+	}
+}
+
+func TestGroupSearchOptional(t *testing.T) {
+	addr, stop := fakeServer(t, func(req *ber.Packet, controls []ldap.Control) []fakeResponse {
+		if baseDN, _ := req.Children[0].Value.(string); baseDN == "ou=groups,dc=example,dc=com" {
+			return []fakeResponse{{op: fakeResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultUnavailable)}}
+		}
+		return []fakeResponse{
+			{op: fakeEntry("uid=jane,ou=people,dc=example,dc=com", map[string][]string{"uid": {"jane"}, "mail": {"jane@example.com"}})},
+			{op: fakeResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)},
+		}
+	})
+	defer stop()
+
+	c := testConfig()
+	c.Host = addr
+	c.InsecureNoSSL = true
+	c.UserSearch.IDAttr = "uid"
+	c.UserSearch.EmailAttr = "mail"
+	c.GroupSearch.BaseDN = "ou=groups,dc=example,dc=com"
+	c.GroupSearch.UserAttr = "uid"
+	c.GroupSearch.GroupAttr = "memberUid"
+	c.GroupSearch.NameAttr = "cn"
+	conn, err := c.OpenConnector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := conn.Login(context.Background(), connector.Scopes{Groups: true}, "jane", "password"); err == nil {
+		t.Errorf("expected a failed groups query to fail the login by default")
+	}
+
+	c.GroupSearch.Optional = true
+	if conn, err = c.OpenConnector(); err != nil {
+		t.Fatal(err)
+	}
+	ident, valid, err := conn.Login(context.Background(), connector.Scopes{Groups: true}, "jane", "password")
+	if err != nil || !valid {
+		t.Fatalf("expected login to succeed without groups, got valid=%t err=%v", valid, err)
+	}
+	if len(ident.Groups) != 0 {
+		t.Errorf("expected no groups, got %q", ident.Groups)
+	}
+
+	c.GroupSearch.RequiredGroups = []string{"admins"}
+	if _, err := c.OpenConnector(); err == nil {
+		t.Errorf("expected error combining optional with requiredGroups")
+	}
+}
+
+func TestGroupNameValues(t *testing.T) {
+	addr, stop := fakeServer(t, func(req *ber.Packet, controls []ldap.Control) []fakeResponse {
+		if baseDN, _ := req.Children[0].Value.(string); baseDN == "ou=groups,dc=example,dc=com" {
+			return []fakeResponse{
+				{op: fakeEntry("cn=admins,ou=groups,dc=example,dc=com", map[string][]string{"cn": {"admins", "administrators"}})},
+				{op: fakeEntry("cn=devs,ou=groups,dc=example,dc=com", map[string][]string{"cn": {"devs"}})},
+				{op: fakeResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)},
+			}
+		}
+		return []fakeResponse{
+			{op: fakeEntry("uid=jane,ou=people,dc=example,dc=com", map[string][]string{"uid": {"jane"}, "mail": {"jane@example.com"}})},
+			{op: fakeResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)},
+		}
+	})
+	defer stop()
+
+	tests := []struct {
+		nameValues string
+		want       []string
+		wantErr    bool
+	}{
+		{"", []string{"admins", "devs"}, false},
+		{"first", []string{"admins", "devs"}, false},
+		{"all", []string{"administrators", "admins", "devs"}, false},
+		{"error", nil, true},
+	}
+	for _, test := range tests {
+		c := testConfig()
+		c.Host = addr
+		c.InsecureNoSSL = true
+		c.UserSearch.IDAttr = "uid"
+		c.UserSearch.EmailAttr = "mail"
+		c.GroupSearch.BaseDN = "ou=groups,dc=example,dc=com"
+		c.GroupSearch.UserAttr = "uid"
+		c.GroupSearch.GroupAttr = "memberUid"
+		c.GroupSearch.NameAttr = "cn"
+		c.GroupSearch.NameValues = test.nameValues
+		conn, err := c.OpenConnector()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ident, _, err := conn.Login(context.Background(), connector.Scopes{Groups: true}, "jane", "password")
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("nameValues %q: expected error for a group with several names", test.nameValues)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("nameValues %q: %v", test.nameValues, err)
+			continue
+		}
+		if !reflect.DeepEqual(ident.Groups, test.want) {
+			t.Errorf("nameValues %q: expected groups %q, got %q", test.nameValues, test.want, ident.Groups)
+		}
+	}
+
+	c := testConfig()
+	c.GroupSearch.BaseDN = "ou=groups,dc=example,dc=com"
+	c.GroupSearch.NameAttr = "cn"
+	c.GroupSearch.NameValues = "last"
+	if _, err := c.OpenConnector(); err == nil {
+		t.Errorf("expected error for unknown nameValues")
+	}
+}
+
+func TestLDAPIHost(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dex-ldapi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := dir + "/ldapi"
+
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	var (
+		mu          sync.Mutex
+		saslBinds   int
+		mechanismOK = true
+	)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			// Answer the SASL EXTERNAL bind, then hand the connection to the
+			// fake server for the search.
+			go func() {
+				req, err := ber.ReadPacket(conn)
+				if err != nil {
+					conn.Close()
+					return
+				}
+				mu.Lock()
+				saslBinds++
+				if req.Children[1].Children[2].Children[0].Value != "EXTERNAL" {
+					mechanismOK = false
+				}
+				mu.Unlock()
+				resp := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+				resp.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, rawMessageID, "MessageID"))
+				resp.AppendChild(fakeResult(ldap.ApplicationBindResponse, ldap.LDAPResultSuccess))
+				conn.Write(resp.Bytes())
+				serveFake(conn, func(boundDN string, req *ber.Packet, controls []ldap.Control) []fakeResponse {
+					return []fakeResponse{
+						{op: fakeEntry("uid=jane,ou=people,dc=example,dc=com", map[string][]string{"uid": {"jane"}, "mail": {"jane@example.com"}})},
+						{op: fakeResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)},
+					}
+				})
+			}()
+		}
+	}()
+
+	for _, host := range []string{"ldapi://" + socket, "ldapi://" + url.PathEscape(socket)} {
+		c := testConfig()
+		c.Host = host
+		c.AnonymousBind = false
+		c.BindMode = bindModeExternal
+		c.UserSearch.IDAttr = "uid"
+		c.UserSearch.EmailAttr = "mail"
+		conn, err := c.OpenConnector()
+		if err != nil {
+			t.Fatalf("host %q: %v", host, err)
+		}
+		ident, valid, err := conn.Login(context.Background(), connector.Scopes{}, "jane", "password")
+		if err != nil || !valid {
+			t.Fatalf("host %q: expected login to succeed, got valid=%t err=%v", host, valid, err)
+		}
+		if ident.Email != "jane@example.com" {
+			t.Errorf("host %q: expected email %q, got %q", host, "jane@example.com", ident.Email)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if saslBinds == 0 || !mechanismOK {
+		t.Errorf("expected SASL EXTERNAL binds over the socket, got %d binds", saslBinds)
+	}
+
+	c := testConfig()
+	c.Host = "ldapi://var%2Frun%2Fldapi"
+	if _, err := c.OpenConnector(); err == nil {
+		t.Errorf("expected error for a relative socket path")
+	}
+	c.Host = "ldapi:///var/run/ldapi"
+	c.FailoverHosts = []HostConfig{{Host: "ldap2.example.com"}}
+	if _, err := c.OpenConnector(); err == nil {
+		t.Errorf("expected error combining an ldapi host with failoverHosts")
+	}
+}
+
+func TestGroupSearchBaseDNTemplate(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		baseDNs []string
+	)
+	addr, stop := fakeServer(t, func(req *ber.Packet, controls []ldap.Control) []fakeResponse {
+		baseDN, _ := req.Children[0].Value.(string)
+		if strings.HasPrefix(baseDN, "ou=groups,") {
+			mu.Lock()
+			baseDNs = append(baseDNs, baseDN)
+			mu.Unlock()
+			return []fakeResponse{
+				{op: fakeEntry("cn=emea-staff,"+baseDN, map[string][]string{"cn": {"emea-staff"}})},
+				{op: fakeResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)},
+			}
+		}
+		return []fakeResponse{
+			{op: fakeEntry(`uid=jane,ou=people,ou=emea\, west,dc=example,dc=com`, map[string][]string{"uid": {"jane"}, "mail": {"jane@example.com"}})},
+			{op: fakeResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)},
+		}
+	})
+	defer stop()
+
+	c := testConfig()
+	c.Host = addr
+	c.InsecureNoSSL = true
+	c.UserSearch.IDAttr = "uid"
+	c.UserSearch.EmailAttr = "mail"
+	c.GroupSearch.BaseDN = "ou=groups,{{parentDN .UserDN 2}}"
+	c.GroupSearch.UserAttr = "uid"
+	c.GroupSearch.GroupAttr = "memberUid"
+	c.GroupSearch.NameAttr = "cn"
+	conn, err := c.OpenConnector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ident, valid, err := conn.Login(context.Background(), connector.Scopes{Groups: true}, "jane", "password")
+	if err != nil || !valid {
+		t.Fatalf("expected login to succeed, got valid=%t err=%v", valid, err)
+	}
+	if !reflect.DeepEqual(ident.Groups, []string{"emea-staff"}) {
+		t.Errorf("expected groups %q, got %q", []string{"emea-staff"}, ident.Groups)
+	}
+	want := []string{`ou=groups,ou=emea\, west,dc=example,dc=com`}
+	mu.Lock()
+	defer mu.Unlock()
+	if !reflect.DeepEqual(baseDNs, want) {
+		t.Errorf("expected group search base DNs %q, got %q", want, baseDNs)
+	}
+
+	if _, err := parentDN("uid=jane,dc=example", 2); err == nil {
+		t.Errorf("expected error removing more RDNs than the DN has")
+	}
+	c.GroupSearch.BaseDN = "ou=groups,{{parentDN .UserDN"
+	if _, err := c.OpenConnector(); err == nil {
+		t.Errorf("expected error for an invalid groupSearch.baseDN template")
+	}
+}
+
+func TestGroupClaimsMaxGroups(t *testing.T) {
+	c := testConfig()
+	c.GroupSearch.BaseDN = "ou=groups,dc=example,dc=com"
+	c.GroupSearch.UserAttr = "uid"
+	c.GroupSearch.GroupAttr = "memberUid"
+	c.GroupSearch.NameAttr = "cn"
+	c.GroupSearch.MaxGroups = 3
+	c.GroupSearch.PriorityGroups = []string{"vpn-users", "missing", "admins"}
+
+	var buf bytes.Buffer
+	conn, err := c.OpenConnector(WithLogger(log.New(&buf, "", 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lc := conn.(*ldapConnector)
+
+	groups := []string{"admins", "building-3", "cafeteria", "developers", "vpn-users"}
+	if got, want := lc.groupClaims(context.Background(), "uid=jane,ou=people,dc=example,dc=com", groups), []string{"admins", "building-3", "vpn-users"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("want=%q, got=%q", want, got)
+	}
+	if !strings.Contains(buf.String(), "has 5 groups") {
+		t.Errorf("expected a log message about the truncated groups, got %q", buf.String())
+	}
+
+	buf.Reset()
+	groups = []string{"admins", "developers"}
+	if got := lc.groupClaims(context.Background(), "uid=jane,ou=people,dc=example,dc=com", groups); !reflect.DeepEqual(got, groups) {
+		t.Errorf("want=%q, got=%q", groups, got)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("expected no log message without truncation, got %q", buf.String())
+	}
+
+	c.GroupSearch.MaxGroups = 0
+	if _, err := c.OpenConnector(); err == nil {
+		t.Errorf("expected error for priorityGroups without maxGroups")
+	}
+	c.GroupSearch.MaxGroups = -1
+	if _, err := c.OpenConnector(); err == nil {
+		t.Errorf("expected error for negative maxGroups")
+	}
+}
+
+func TestGroupClaimsNameCase(t *testing.T) {
+	groups := []string{"Engineering", "admins", "engineering", "ENGINEERING", "ops"}
+	tests := []struct {
+		nameCase  string
+		priority  []string
+		maxGroups int
+		want      []string
+	}{
+		{nameCase: "", want: []string{"Admins", "ENGINEERING", "Engineering", "engineering", "ops"}},
+		{nameCase: "preserve", want: []string{"Admins", "ENGINEERING", "ops"}},
+		// The spelling in the configuration is canonical.
+		{nameCase: "preserve", priority: []string{"engineering", "OPS"}, maxGroups: 10, want: []string{"Admins", "OPS", "engineering"}},
+		{nameCase: "lower", want: []string{"admins", "engineering", "ops"}},
+		// priorityGroups are matched case insensitively.
+		{nameCase: "lower", priority: []string{"OPS"}, maxGroups: 1, want: []string{"ops"}},
+		{nameCase: "preserve", priority: []string{"OPS"}, maxGroups: 1, want: []string{"OPS"}},
+		{nameCase: "", priority: []string{"OPS"}, maxGroups: 1, want: []string{"Admins"}},
+	}
+	for _, test := range tests {
+		c := testConfig()
+		c.GroupSearch.BaseDN = "ou=groups,dc=example,dc=com"
+		c.GroupSearch.UserAttr = "uid"
+		c.GroupSearch.GroupAttr = "memberUid"
+		c.GroupSearch.NameAttr = "cn"
+		c.GroupSearch.NameCase = test.nameCase
+		c.GroupSearch.PriorityGroups = test.priority
+		c.GroupSearch.MaxGroups = test.maxGroups
+		// Applied after roleMapping.
+		c.GroupSearch.RoleMapping = map[string]string{"admins": "Admins"}
+		conn, err := c.OpenConnector()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := conn.(*ldapConnector).groupClaims(context.Background(), "uid=jane,ou=people,dc=example,dc=com", uniqueSorted(groups))
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("nameCase %q priorityGroups %q: want=%q, got=%q", test.nameCase, test.priority, test.want, got)
+		}
+	}
+
+	// requiredGroups and adminGroups are matched case insensitively too.
+	for _, nameCase := range []string{"", "preserve", "lower"} {
+		c := testConfig()
+		c.GroupSearch.BaseDN = "ou=groups,dc=example,dc=com"
+		c.GroupSearch.UserAttr = "uid"
+		c.GroupSearch.GroupAttr = "memberUid"
+		c.GroupSearch.NameAttr = "cn"
+		c.GroupSearch.NameCase = nameCase
+		c.GroupSearch.RequiredGroups = []string{"OPS"}
+		c.GroupSearch.AdminGroups = []string{"ADMINS"}
+		c.GroupSearch.AdminRole = "Admin"
+		conn, err := c.OpenConnector()
+		if err != nil {
+			t.Fatal(err)
+		}
+		lc := conn.(*ldapConnector)
+		user := ldap.NewEntry("uid=jane,ou=people,dc=example,dc=com", nil)
+		err = lc.checkRequiredGroups(*user, []string{"admins", "ops"})
+		claims := lc.groupClaims(context.Background(), user.DN, []string{"admins", "ops"})
+		if exact := nameCase == ""; (err == nil) == exact || lc.memberOfAnyGroup(claims, []string{"Admin"}) == exact {
+			t.Errorf("nameCase %q: unexpected required group error %v or claims %q", nameCase, err, claims)
+		}
+	}
+
+	c := testConfig()
+	c.GroupSearch.NameCase = "upper"
+	if _, err := c.OpenConnector(); err == nil {
+		t.Errorf("expected error for unknown nameCase")
+	}
+}
+
+func TestStartTLS(t *testing.T) {
+	caPEM, cert := testCertificates(t, "ldap.example.com")
+	otherCAPEM, _ := testCertificates(t, "ldap.example.com")
+	addr, stop := startTLSServer(t, cert, func(req *ber.Packet, controls []ldap.Control) []fakeResponse {
+		return []fakeResponse{
+			{op: fakeEntry("uid=jane,ou=people,dc=example,dc=com", map[string][]string{"uid": {"jane"}, "mail": {"jane@example.com"}})},
+			{op: fakeResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)},
+		}
+	})
+	defer stop()
+
+	tests := []struct {
+		name       string
+		rootCA     []byte
+		serverName string
+		wantErr    bool
+	}{
+		{name: "verified", rootCA: caPEM, serverName: "ldap.example.com"},
+		{name: "wrong CA", rootCA: otherCAPEM, serverName: "ldap.example.com", wantErr: true},
+		{name: "hostname mismatch", rootCA: caPEM, serverName: "other.example.com", wantErr: true},
+	}
+	for _, test := range tests {
+		// The server's certificate names ldap.example.com, which doesn't resolve,
+		// so reach the test server as a failover host with a serverName.
+		c := testConfig()
+		c.Host = "ldap.invalid"
+		c.StartTLS = true
+		c.RootCAData = test.rootCA
+		c.FailoverHosts = []HostConfig{{Host: addr, ServerName: test.serverName}}
+		c.UserSearch.IDAttr = "uid"
+		c.UserSearch.EmailAttr = "mail"
+		conn, err := c.OpenConnector()
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		_, valid, err := conn.Login(context.Background(), connector.Scopes{}, "jane", "password")
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%s: expected StartTLS to fail verification", test.name)
+			}
+			continue
+		}
+		if err != nil || !valid {
+			t.Errorf("%s: expected login to succeed, got valid=%t err=%v", test.name, valid, err)
+		}
+	}
+
+	c := testConfig()
+	c.StartTLS = true
+	c.InsecureNoSSL = true
+	if _, err := c.OpenConnector(); err == nil {
+		t.Errorf("expected error when startTLS and insecureNoSSL are both set")
+	}
+}
+
+func TestPort(t *testing.T) {
+	tests := []struct {
+		name          string
+		host          string
+		port          int
+		insecureNoSSL bool
+		startTLS      bool
+		noSSLTLSPort  bool
+		want          string
+		wantFailover  string
+		wantErr       bool
+	}{
+		{name: "tls", host: "ldap.example.com", want: "ldap.example.com:636", wantFailover: "dr.example.com:636"},
+		{name: "plain", host: "ldap.example.com", insecureNoSSL: true, want: "ldap.example.com:389", wantFailover: "dr.example.com:636"},
+		{name: "starttls", host: "ldap.example.com", startTLS: true, want: "ldap.example.com:389", wantFailover: "dr.example.com:389"},
+		{name: "override", host: "ldap.example.com", port: 10636, want: "ldap.example.com:10636", wantFailover: "dr.example.com:10636"},
+		{name: "ipv6", host: "::1", startTLS: true, want: "[::1]:389", wantFailover: "dr.example.com:389"},
+		{name: "host with port", host: "ldap.example.com:389", want: "ldap.example.com:389", wantFailover: "dr.example.com:636"},
+		{name: "port and host with port", host: "ldap.example.com:389", port: 389, wantErr: true},
+		{name: "out of range", host: "ldap.example.com", port: 70000, wantErr: true},
+		{name: "plain on tls port", host: "ldap.example.com:636", insecureNoSSL: true, wantErr: true},
+		{name: "plain on tls port override", host: "ldap.example.com", port: 3269, insecureNoSSL: true, wantErr: true},
+		{name: "plain on tls port acknowledged", host: "ldap.example.com:636", insecureNoSSL: true, noSSLTLSPort: true, want: "ldap.example.com:636", wantFailover: "dr.example.com:636"},
+		{name: "acknowledged without insecureNoSSL", host: "ldap.example.com", noSSLTLSPort: true, wantErr: true},
+	}
+	for _, test := range tests {
+		c := testConfig()
+		c.Host = test.host
+		c.Port = test.port
+		c.InsecureNoSSL = test.insecureNoSSL
+		c.StartTLS = test.startTLS
+		c.InsecureNoSSLOnTLSPort = test.noSSLTLSPort
+		c.FailoverHosts = []HostConfig{{Host: "dr.example.com"}}
+		conn, err := c.OpenConnector()
+		if err != nil {
+			if !test.wantErr {
+				t.Errorf("%s: %v", test.name, err)
+			}
+			continue
+		}
+		if test.wantErr {
+			t.Errorf("%s: expected error", test.name)
+			continue
+		}
+		endpoints := conn.(*ldapConnector).endpoints
+		if got := endpoints[0].addr; got != test.want {
+			t.Errorf("%s: want addr %q, got %q", test.name, test.want, got)
+		}
+		if got := endpoints[1].addr; got != test.wantFailover {
+			t.Errorf("%s: want failover addr %q, got %q", test.name, test.wantFailover, got)
+		}
+	}
+}
+
+func TestSecureOnly(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(c *Config)
+		wantErr bool
+	}{
+		{name: "tls", modify: func(c *Config) {}},
+		{name: "starttls", modify: func(c *Config) { c.StartTLS = true }},
+		{name: "insecureNoSSL", modify: func(c *Config) { c.InsecureNoSSL = true }, wantErr: true},
+		{name: "insecureSkipVerify", modify: func(c *Config) { c.InsecureSkipVerify = true }, wantErr: true},
+		{name: "insecureSkipHostnameVerify", modify: func(c *Config) { c.InsecureSkipHostnameVerify = true }, wantErr: true},
+		{
+			name: "failover insecureNoSSL",
+			modify: func(c *Config) {
+				c.FailoverHosts = []HostConfig{{Host: "dr.example.com", InsecureNoSSL: true}}
+			},
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		c := testConfig()
+		c.SecureOnly = true
+		test.modify(c)
+		_, err := c.OpenConnector()
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: wantErr=%t, got err=%v", test.name, test.wantErr, err)
+		}
+	}
+}
+
+func TestGroupSearchIDAttr(t *testing.T) {
+	guid := string([]byte{0x01, 0xff, 0x80, 0x7f})
+	addr, stop := fakeServer(t, func(req *ber.Packet, controls []ldap.Control) []fakeResponse {
+		if baseDN, _ := req.Children[0].Value.(string); baseDN == "ou=groups,dc=example,dc=com" {
+			return []fakeResponse{
+				{op: fakeEntry("cn=admins,ou=groups,dc=example,dc=com", map[string][]string{"cn": {"admins"}, "objectGUID": {guid}})},
+				{op: fakeResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)},
+			}
+		}
+		return []fakeResponse{
+			{op: fakeEntry("uid=jane,ou=people,dc=example,dc=com", map[string][]string{"uid": {"jane"}, "mail": {"jane@example.com"}})},
+			{op: fakeResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)},
+		}
+	})
+	defer stop()
+
+	c := testConfig()
+	c.Host = addr
+	c.InsecureNoSSL = true
+	c.UserSearch.IDAttr = "uid"
+	c.UserSearch.EmailAttr = "mail"
+	c.GroupSearch.BaseDN = "ou=groups,dc=example,dc=com"
+	c.GroupSearch.UserAttr = "uid"
+	c.GroupSearch.GroupAttr = "memberUid"
+	c.GroupSearch.NameAttr = "cn"
+	c.GroupSearch.IDAttr = "objectGUID"
+	c.GroupSearch.IDEncoding = "hex"
+	conn, err := c.OpenConnector()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ident, _, err := conn.Login(context.Background(), connector.Scopes{Groups: true}, "jane", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"admins"}; !reflect.DeepEqual(ident.Groups, want) {
+		t.Errorf("expected groups claim %q, got %q", want, ident.Groups)
+	}
+	var data ConnectorData
+	if err := json.Unmarshal(ident.ConnectorData, &data); err != nil {
+		t.Fatal(err)
+	}
+	if want := []Group{{Name: "admins", ID: "01ff807f"}}; !reflect.DeepEqual(data.GroupDetails, want) {
+		t.Errorf("expected group details %+v, got %+v", want, data.GroupDetails)
+	}
+
+	// Without the groups scope, groups aren't exposed.
+	ident, _, err = conn.Login(context.Background(), connector.Scopes{}, "jane", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ident.ConnectorData) != 0 {
+		t.Errorf("expected no connector data without the groups scope, got %s", ident.ConnectorData)
+	}
+
+	c.GroupSearch.IDEncoding = "base32"
+	if _, err := c.OpenConnector(); err == nil {
+		t.Errorf("expected error for unknown idEncoding")
+	}
+}
+
+func TestIDValues(t *testing.T) {
+	user := ldap.NewEntry("uid=jane,ou=people,dc=example,dc=com", map[string][]string{
+		"uid":  {"jane", "jdoe"},
+		"mail": {"jane@example.com"},
+	})
+
+	c := testConfig()
+	c.UserSearch.IDAttr = "uid"
+	c.UserSearch.EmailAttr = "mail"
+	conn, err := c.OpenConnector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.(*ldapConnector).identityFromEntry(*user); err == nil {
+		t.Errorf("expected error for an entry with several IDs")
+	}
+
+	c.UserSearch.IDValues = "first"
+	if conn, err = c.OpenConnector(); err != nil {
+		t.Fatal(err)
+	}
+	ident, err := conn.(*ldapConnector).identityFromEntry(*user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ident.UserID != "jane" {
+		t.Errorf("expected the first ID, got %q", ident.UserID)
+	}
+
+	var buf bytes.Buffer
+	c.UserSearch.IDAttr = "mail"
+	c.UserSearch.IDValues = ""
+	if _, err := c.OpenConnector(WithLogger(log.New(&buf, "", 0))); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "usually multi-valued") {
+		t.Errorf("expected a warning for a multi-valued idAttr, got %q", buf.String())
+	}
+
+	c.UserSearch.IDValues = "strict"
+	if _, err := c.OpenConnector(); err == nil {
+		t.Errorf("expected error for a multi-valued idAttr in strict mode")
+	}
+	c.UserSearch.IDAttr = "uid"
+	if _, err := c.OpenConnector(); err != nil {
+		t.Errorf("strict mode with uid: %v", err)
+	}
+	c.UserSearch.IDValues = "last"
+	if _, err := c.OpenConnector(); err == nil {
+		t.Errorf("expected error for unknown idValues")
+	}
+}
+
+func TestOnMultiple(t *testing.T) {
+	addr, stop := fakeServer(t, func(req *ber.Packet, controls []ldap.Control) []fakeResponse {
+		// Returned out of order, "first" must sort them.
+		return []fakeResponse{
+			{op: fakeEntry("uid=jane,ou=people,dc=example,dc=com", map[string][]string{"uid": {"jane"}, "mail": {"jane@example.com"}})},
+			{op: fakeEntry("uid=jane,ou=contractors,dc=example,dc=com", map[string][]string{"uid": {"jane.c"}, "mail": {"jane.c@example.com"}})},
+			{op: fakeResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)},
+		}
+	})
+	defer stop()
+
+	tests := []struct {
+		onMultiple string
+		wantID     string
+		wantValid  bool
+		wantErr    bool
+	}{
+		{onMultiple: "", wantErr: true},
+		{onMultiple: "error", wantErr: true},
+		{onMultiple: "fail", wantValid: false},
+		{onMultiple: "first", wantID: "jane.c", wantValid: true},
+	}
+	for _, test := range tests {
+		c := testConfig()
+		c.Host = addr
+		c.InsecureNoSSL = true
+		c.UserSearch.IDAttr = "uid"
+		c.UserSearch.EmailAttr = "mail"
+		c.UserSearch.OnMultiple = test.onMultiple
+
+		conn, err := c.OpenConnector()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ident, valid, err := conn.Login(context.Background(), connector.Scopes{}, "jane", "password")
+		conn.Close()
+		if (err != nil) != test.wantErr {
+			t.Errorf("onMultiple=%q: want error %t, got %v", test.onMultiple, test.wantErr, err)
+			continue
+		}
+		if valid != test.wantValid {
+			t.Errorf("onMultiple=%q: want valid=%t, got %t", test.onMultiple, test.wantValid, valid)
+		}
+		if ident.UserID != test.wantID {
+			t.Errorf("onMultiple=%q: want user ID %q, got %q", test.onMultiple, test.wantID, ident.UserID)
+		}
+	}
+}
+
+func TestRootDSE(t *testing.T) {
+	addr, stop := fakeServer(t, func(req *ber.Packet, controls []ldap.Control) []fakeResponse {
+		if baseDN, _ := req.Children[0].Value.(string); baseDN != "" {
+			t.Errorf("expected a search of the empty DN, got %q", baseDN)
+		}
+		if scope, ok := req.Children[1].Value.(int64); !ok || scope != int64(ldap.ScopeBaseObject) {
+			t.Errorf("expected a base object search, got scope %v", req.Children[1].Value)
+		}
+		return []fakeResponse{
+			{op: fakeEntry("", map[string][]string{
+				"namingContexts":          {"dc=example,dc=com"},
+				"supportedControl":        {ldap.ControlTypePaging, ldap.ControlTypeBeheraPasswordPolicy},
+				"supportedSASLMechanisms": {"EXTERNAL"},
+			})},
+			{op: fakeResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)},
+		}
+	})
+	defer stop()
+
+	c := testConfig()
+	c.Host = addr
+	c.InsecureNoSSL = true
+	conn, err := c.OpenConnector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	dse, err := conn.(*ldapConnector).RootDSE(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := RootDSE{
+		NamingContexts:          []string{"dc=example,dc=com"},
+		SupportedControls:       []string{ldap.ControlTypePaging, ldap.ControlTypeBeheraPasswordPolicy},
+		SupportedSASLMechanisms: []string{"EXTERNAL"},
+	}
+	if !reflect.DeepEqual(dse, want) {
+		t.Errorf("want=%+v, got=%+v", want, dse)
+	}
+	if !dse.SupportsControl(ldap.ControlTypePaging) || dse.SupportsControl(ldap.ControlTypeVChuPasswordMustChange) {
+		t.Errorf("unexpected supported controls %q", dse.SupportedControls)
+	}
+}
+
+func TestSearchReferral(t *testing.T) {
+	referred, stopReferred := fakeServer(t, func(req *ber.Packet, controls []ldap.Control) []fakeResponse {
+		if baseDN, _ := req.Children[0].Value.(string); baseDN != "ou=people,dc=child,dc=example,dc=com" {
+			t.Errorf("referred search with unexpected base DN %q", baseDN)
+		}
+		return []fakeResponse{
+			{op: fakeEntry("uid=jane,ou=people,dc=child,dc=example,dc=com", map[string][]string{"uid": {"jane"}, "mail": {"jane@example.com"}})},
+			{op: fakeResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)},
+		}
+	})
+	defer stopReferred()
+
+	addr, stop := fakeServer(t, func(req *ber.Packet, controls []ldap.Control) []fakeResponse {
+		return []fakeResponse{
+			{op: fakeReferral("ldap://" + referred + "/ou=people,dc=child,dc=example,dc=com")},
+			{op: fakeResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)},
+		}
+	})
+	defer stop()
+
+	c := testConfig()
+	c.Host = addr
+	c.InsecureNoSSL = true
+	c.UserSearch.IDAttr = "uid"
+	c.UserSearch.EmailAttr = "mail"
+
+	conn, err := c.OpenConnector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = conn.Login(context.Background(), connector.Scopes{}, "jane", "password")
+	conn.Close()
+	if err == nil || !strings.Contains(err.Error(), "set followReferrals") {
+		t.Errorf("expected a referral error without followReferrals, got %v", err)
+	}
+
+	c.FollowReferrals = true
+	conn, err = c.OpenConnector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ident, valid, err := conn.Login(context.Background(), connector.Scopes{}, "jane", "password")
+	if err != nil || !valid {
+		t.Fatalf("login failed: valid=%t err=%v", valid, err)
+	}
+	if ident.UserID != "jane" {
+		t.Errorf("expected the user entry of the referred server, got %+v", ident)
+	}
+}
+
+func TestSearchMixedReferral(t *testing.T) {
+	referred, stopReferred := fakeServer(t, func(req *ber.Packet, controls []ldap.Control) []fakeResponse {
+		if baseDN, _ := req.Children[0].Value.(string); baseDN != "ou=groups,dc=child,dc=example,dc=com" {
+			t.Errorf("referred search with unexpected base DN %q", baseDN)
+		}
+		return []fakeResponse{
+			{op: fakeEntry("cn=devs,ou=groups,dc=child,dc=example,dc=com", map[string][]string{"cn": {"devs"}})},
+			{op: fakeResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)},
+		}
+	})
+	defer stopReferred()
+
+	addr, stop := fakeServer(t, func(req *ber.Packet, controls []ldap.Control) []fakeResponse {
+		if baseDN, _ := req.Children[0].Value.(string); baseDN == "ou=people,dc=example,dc=com" {
+			return []fakeResponse{
+				{op: fakeEntry("uid=jane,ou=people,dc=example,dc=com", map[string][]string{"uid": {"jane"}, "mail": {"jane@example.com"}})},
+				{op: fakeResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)},
+			}
+		}
+		return []fakeResponse{
+			{op: fakeEntry("cn=admins,ou=groups,dc=example,dc=com", map[string][]string{"cn": {"admins"}})},
+			{op: fakeReferral("ldap://" + referred + "/ou=groups,dc=child,dc=example,dc=com")},
+			{op: fakeResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)},
+		}
+	})
+	defer stop()
+
+	tests := []struct {
+		followReferrals bool
+		want            []string
+		wantLog         string
+	}{
+		{followReferrals: false, want: []string{"admins"}, wantLog: "results may be incomplete"},
+		{followReferrals: true, want: []string{"admins", "devs"}, wantLog: "following them"},
+	}
+	for _, test := range tests {
+		c := testConfig()
+		c.Host = addr
+		c.InsecureNoSSL = true
+		c.UserSearch.IDAttr = "uid"
+		c.UserSearch.EmailAttr = "mail"
+		c.GroupSearch.BaseDN = "ou=groups,dc=example,dc=com"
+		c.GroupSearch.UserAttr = "uid"
+		c.GroupSearch.GroupAttr = "memberUid"
+		c.GroupSearch.NameAttr = "cn"
+		c.FollowReferrals = test.followReferrals
+
+		var buf bytes.Buffer
+		conn, err := c.OpenConnector(WithLogger(log.New(&buf, "", 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ident, valid, err := conn.Login(context.Background(), connector.Scopes{Groups: true}, "jane", "password")
+		conn.Close()
+		if err != nil || !valid {
+			t.Fatalf("followReferrals=%t: login failed: valid=%t err=%v", test.followReferrals, valid, err)
+		}
+		if !reflect.DeepEqual(ident.Groups, test.want) {
+			t.Errorf("followReferrals=%t: want groups %q, got %q", test.followReferrals, test.want, ident.Groups)
+		}
+		if got := buf.String(); !strings.Contains(got, test.wantLog) {
+			t.Errorf("followReferrals=%t: expected log containing %q, got %q", test.followReferrals, test.wantLog, got)
+		}
+	}
+}
+
+func TestTestLogin(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		binds []string
+	)
+	addr, stop := fakeServerBinds(t, func(dn, password string) *ber.Packet {
+		mu.Lock()
+		binds = append(binds, dn)
+		mu.Unlock()
+		// Accept unauthenticated binds like many servers do.
+		if password == "" || password == "secret" {
+			return fakeResult(ldap.ApplicationBindResponse, ldap.LDAPResultSuccess)
+		}
+		return fakeResult(ldap.ApplicationBindResponse, ldap.LDAPResultInvalidCredentials)
+	}, func(boundDN string, req *ber.Packet, controls []ldap.Control) []fakeResponse {
+		return []fakeResponse{
+			{op: fakeEntry("uid=jane,ou=people,dc=example,dc=com", map[string][]string{"uid": {"jane"}, "mail": {"jane@example.com"}})},
+			{op: fakeResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)},
+		}
+	})
+	defer stop()
+	userBinds := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		var dns []string
+		for _, dn := range binds {
+			if dn != "" {
+				dns = append(dns, dn)
+			}
+		}
+		binds = nil
+		return dns
+	}
+
+	c := testConfig()
+	c.Host = addr
+	c.InsecureNoSSL = true
+	c.UserSearch.IDAttr = "uid"
+	c.UserSearch.EmailAttr = "mail"
+
+	d, err := c.TestLogin(context.Background(), "jane", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.UserFilter != "(uid=jane)" || d.UserDN != "uid=jane,ou=people,dc=example,dc=com" || d.Identity.Email != "jane@example.com" {
+		t.Errorf("unexpected diagnostics %+v", d)
+	}
+	if want := []string{"uid=jane,ou=people,dc=example,dc=com"}; !reflect.DeepEqual(userBinds(), want) {
+		t.Errorf("expected a bind as the user")
+	}
+
+	// Logins reject empty passwords, which the server would accept.
+	if _, err := c.TestLogin(context.Background(), "jane", ""); err == nil {
+		t.Errorf("expected error for an empty password")
+	}
+	if dns := userBinds(); len(dns) != 0 {
+		t.Errorf("expected no bind as the user, got %q", dns)
+	}
+
+	c.UserSearch.BindDNTemplate = "uid={{.Username}},ou=people,dc=example,dc=com"
+	d, err = c.TestLogin(context.Background(), "jane", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.UserFilter != "" || d.UserDN != "uid=jane,ou=people,dc=example,dc=com" || d.Identity.Email != "jane@example.com" {
+		t.Errorf("unexpected diagnostics with bindDNTemplate %+v", d)
+	}
+	if want := []string{"uid=jane,ou=people,dc=example,dc=com"}; !reflect.DeepEqual(userBinds(), want) {
+		t.Errorf("expected a bind as the DN built from the template")
+	}
+	if _, err := c.TestLogin(context.Background(), "jane", "wrong"); err == nil {
+		t.Errorf("expected error for a wrong password with bindDNTemplate")
+	}
+}
+
+func TestTestGroups(t *testing.T) {
+	addr, stop := fakeServer(t, func(req *ber.Packet, controls []ldap.Control) []fakeResponse {
+		if baseDN, _ := req.Children[0].Value.(string); baseDN == "ou=people,dc=example,dc=com" {
+			return []fakeResponse{
+				{op: fakeEntry("uid=jane,ou=people,dc=example,dc=com", map[string][]string{"uid": {"jane"}})},
+				{op: fakeResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)},
+			}
+		}
+		return []fakeResponse{
+			{op: fakeEntry("cn=admins,ou=groups,dc=example,dc=com", map[string][]string{"cn": {"admins"}})},
+			{op: fakeEntry("cn=nameless,ou=groups,dc=example,dc=com", nil)},
+			{op: fakeResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)},
+		}
+	})
+	defer stop()
+
+	c := testConfig()
+	c.Host = addr
+	c.InsecureNoSSL = true
+	c.GroupSearch.BaseDN = "ou=groups,dc=example,dc=com"
+	c.GroupSearch.UserAttr = "uid"
+	c.GroupSearch.GroupAttr = "memberUid"
+	c.GroupSearch.NameAttr = "cn"
+	c.GroupSearch.RoleMapping = map[string]string{"admins": "platform-admins"}
+
+	d, err := c.TestGroups(context.Background(), "jane")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &GroupDiagnostics{
+		UserDN:      "uid=jane,ou=people,dc=example,dc=com",
+		GroupBaseDN: "ou=groups,dc=example,dc=com",
+		GroupFilter: "(memberUid=jane)",
+		Matches: []GroupMatch{
+			{DN: "cn=admins,ou=groups,dc=example,dc=com", Groups: []Group{{Name: "admins"}}},
+			// Reported rather than failing, to show the entry lacks nameAttr.
+			{DN: "cn=nameless,ou=groups,dc=example,dc=com", Groups: []Group{}},
+		},
+		Groups: []string{"admins"},
+		Claims: []string{"platform-admins"},
+	}
+	if !reflect.DeepEqual(d, want) {
+		t.Errorf("want=%+v, got=%+v", want, d)
+	}
+
+	c.GroupSearch = testConfig().GroupSearch
+	if _, err := c.TestGroups(context.Background(), "jane"); err == nil {
+		t.Errorf("expected error without groupSearch")
+	}
+}
+
+func TestAllowedAndDeniedUsers(t *testing.T) {
+	addr, stop := fakeServer(t, func(req *ber.Packet, controls []ldap.Control) []fakeResponse {
+		return []fakeResponse{
+			{op: fakeEntry("uid=jane,ou=people,dc=example,dc=com", map[string][]string{"uid": {"jane"}, "mail": {"jane@example.com"}})},
+			{op: fakeResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)},
+		}
+	})
+	defer stop()
+
+	c := testConfig()
+	c.Host = addr
+	c.InsecureNoSSL = true
+	c.UserSearch.Username = []string{"mail", "uid"}
+	c.UserSearch.IDAttr = "uid"
+	c.UserSearch.EmailAttr = "mail"
+	c.AllowedUsers = []string{"Admin", "breakglass", "uid=svc,ou=people,dc=example,dc=com"}
+	c.DeniedUsers = []string{"breakglass "}
+	conn, err := c.OpenConnector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lc := conn.(*ldapConnector)
+
+	tests := []struct {
+		dn    string
+		attrs map[string][]string
+		want  bool
+	}{
+		{dn: "uid=admin,ou=people,dc=example,dc=com", attrs: map[string][]string{"uid": {" ADMIN "}}, want: true},
+		// Any username attribute value matches.
+		{dn: "uid=a1,ou=people,dc=example,dc=com", attrs: map[string][]string{"uid": {"a1", "admin"}}, want: true},
+		{dn: "uid=a1,ou=people,dc=example,dc=com", attrs: map[string][]string{"mail": {"admin"}}, want: true},
+		// So does the DN.
+		{dn: "UID=svc,ou=people,dc=example,dc=com", want: true},
+		// deniedUsers wins over allowedUsers.
+		{dn: "uid=admin,ou=people,dc=example,dc=com", attrs: map[string][]string{"uid": {"admin", "breakglass"}}},
+		{dn: "uid=jane,ou=people,dc=example,dc=com", attrs: map[string][]string{"uid": {"jane"}}},
+	}
+	for _, test := range tests {
+		user := ldap.NewEntry(test.dn, test.attrs)
+		if got := lc.entryPermitted(*user); got != test.want {
+			t.Errorf("%s %v: want permitted=%t, got %t", test.dn, test.attrs, test.want, got)
+		}
+	}
+
+	// The entry found for the typed username is checked, not the typed
+	// username itself.
+	if _, valid, err := lc.Login(context.Background(), connector.Scopes{}, "admin", "password"); err != nil || valid {
+		t.Errorf("expected login to be refused, got valid=%t err=%v", valid, err)
+	}
+	data, err := json.Marshal(ConnectorData{Username: "admin", Entry: ldap.Entry{DN: "uid=jane,ou=people,dc=example,dc=com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lc.Refresh(context.Background(), connector.Scopes{}, connector.Identity{ConnectorData: data}); err == nil {
+		t.Errorf("expected refresh to be refused")
+	}
+
+	c.AllowedUsers = append(c.AllowedUsers, "JANE@example.com")
+	if conn, err = c.OpenConnector(); err != nil {
+		t.Fatal(err)
+	}
+	if _, valid, err := conn.Login(context.Background(), connector.Scopes{}, "jane", "password"); err != nil || !valid {
+		t.Errorf("expected login to succeed, got valid=%t err=%v", valid, err)
+	}
+
+	c.DeniedUsers = []string{" "}
+	if _, err := c.OpenConnector(); err == nil {
+		t.Errorf("expected error for an empty deniedUsers entry")
+	}
+}
+
+func TestUserGroupsAttr(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		searches int
+	)
+	addr, stop := fakeServer(t, func(req *ber.Packet, controls []ldap.Control) []fakeResponse {
+		mu.Lock()
+		searches++
+		mu.Unlock()
+		return []fakeResponse{
+			{op: fakeEntry("uid=jane,ou=people,dc=example,dc=com", map[string][]string{
+				"uid":                  {"jane"},
+				"mail":                 {"jane@example.com"},
+				"eduPersonEntitlement": {"urn:mace:example.com:staff", "urn:mace:example.com:library", "urn:mace:example.com:staff"},
+			})},
+			{op: fakeResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)},
+		}
+	})
+	defer stop()
+
+	c := testConfig()
+	c.Host = addr
+	c.InsecureNoSSL = true
+	c.UserSearch.IDAttr = "uid"
+	c.UserSearch.EmailAttr = "mail"
+	c.GroupSearch.UserGroupsAttr = "eduPersonEntitlement"
+	c.GroupSearch.RoleMapping = map[string]string{"urn:mace:example.com:staff": "staff"}
+	c.GroupSearch.RequiredGroups = []string{"urn:mace:example.com:staff"}
+	conn, err := c.OpenConnector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !conn.(*ldapConnector).Capabilities().Groups {
+		t.Errorf("expected groups to be supported")
+	}
+
+	for _, s := range []connector.Scopes{{Groups: true}, {}} {
+		ident, valid, err := conn.Login(context.Background(), s, "jane", "secret")
+		if err != nil || !valid {
+			t.Fatalf("groups=%t: expected valid login, got valid=%t err=%v", s.Groups, valid, err)
+		}
+		var want []string
+		if s.Groups {
+			want = []string{"staff", "urn:mace:example.com:library"}
+		}
+		if !reflect.DeepEqual(ident.Groups, want) {
+			t.Errorf("groups=%t: want groups %q, got %q", s.Groups, want, ident.Groups)
+		}
+	}
+	mu.Lock()
+	if searches != 2 {
+		t.Errorf("expected only the user to be searched for, got %d searches", searches)
+	}
+	mu.Unlock()
+
+	c.GroupSearch.RequiredGroups = []string{"urn:mace:example.com:faculty"}
+	if conn, err = c.OpenConnector(); err != nil {
+		t.Fatal(err)
+	}
+	if _, valid, err := conn.Login(context.Background(), connector.Scopes{}, "jane", "secret"); err != nil || valid {
+		t.Errorf("expected login without a required group to be refused, got valid=%t err=%v", valid, err)
+	}
+
+	c.GroupSearch.BaseDN = "ou=groups,dc=example,dc=com"
+	if _, err := c.OpenConnector(); err == nil {
+		t.Errorf("expected error combining userGroupsAttr with baseDN")
+	}
+}
+
+func TestGroupsRefreshInterval(t *testing.T) {
+	var (
+		mu           sync.Mutex
+		groupQueries int
+	)
+	addr, stop := fakeServer(t, func(req *ber.Packet, controls []ldap.Control) []fakeResponse {
+		if baseDN, _ := req.Children[0].Value.(string); baseDN == "ou=groups,dc=example,dc=com" {
+			mu.Lock()
+			groupQueries++
+			mu.Unlock()
+			return []fakeResponse{
+				{op: fakeEntry("cn=admins,ou=groups,dc=example,dc=com", map[string][]string{"cn": {"admins"}})},
+				{op: fakeResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)},
+			}
+		}
+		return []fakeResponse{
+			{op: fakeEntry("uid=jane,ou=people,dc=example,dc=com", map[string][]string{"uid": {"jane"}, "mail": {"jane@example.com"}})},
+			{op: fakeResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)},
+		}
+	})
+	defer stop()
+	queries := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return groupQueries
+	}
+
+	c := testConfig()
+	c.Host = addr
+	c.InsecureNoSSL = true
+	c.UserSearch.IDAttr = "uid"
+	c.UserSearch.EmailAttr = "mail"
+	c.GroupSearch.BaseDN = "ou=groups,dc=example,dc=com"
+	c.GroupSearch.UserAttr = "uid"
+	c.GroupSearch.GroupAttr = "memberUid"
+	c.GroupSearch.NameAttr = "cn"
+	c.GroupSearch.RefreshInterval = "1h"
+	c.GroupSearch.RefreshJitter = "5m"
+	conn, err := c.OpenConnector()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := connector.Scopes{OfflineAccess: true, Groups: true}
+	ident, valid, err := conn.Login(context.Background(), s, "jane", "secret")
+	if err != nil || !valid {
+		t.Fatalf("expected valid login, got valid=%t err=%v", valid, err)
+	}
+	if queries() != 1 {
+		t.Fatalf("expected groups to be queried at login, got %d queries", queries())
+	}
+
+	refreshed, err := conn.Refresh(context.Background(), s, ident)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if queries() != 1 {
+		t.Errorf("expected stored groups to be reused, got %d queries", queries())
+	}
+	if want := []string{"admins"}; !reflect.DeepEqual(refreshed.Groups, want) {
+		t.Errorf("want groups %q, got %q", want, refreshed.Groups)
+	}
+	var data ConnectorData
+	if err := json.Unmarshal(refreshed.ConnectorData, &data); err != nil {
+		t.Fatal(err)
+	}
+	if data.GroupsQueried == nil {
+		t.Fatal("expected the time the groups were queried to be kept")
+	}
+
+	stale := data.GroupsQueried.Add(-time.Hour)
+	data.GroupsQueried = &stale
+	if refreshed.ConnectorData, err = json.Marshal(data); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Refresh(context.Background(), s, refreshed); err != nil {
+		t.Fatal(err)
+	}
+	if queries() != 2 {
+		t.Errorf("expected stale groups to be queried again, got %d queries", queries())
+	}
+
+	c.GroupSearch.RefreshJitter = "2h"
+	if _, err := c.OpenConnector(); err == nil {
+		t.Errorf("expected error for refreshJitter longer than refreshInterval")
+	}
+}
+
+func TestFallbackBaseDNs(t *testing.T) {
+	entries := map[string][]string{
+		"ou=people,dc=example,dc=com":      {"uid=jane,ou=people,dc=example,dc=com"},
+		"ou=contractors,dc=example,dc=com": {"uid=bob,ou=contractors,dc=example,dc=com", "uid=bob,ou=temps,ou=contractors,dc=example,dc=com"},
+		"ou=external,dc=example,dc=com":    {"uid=alice,ou=external,dc=example,dc=com"},
+	}
+	var (
+		mu       sync.Mutex
+		searched []string
+	)
+	addr, stop := fakeServer(t, func(req *ber.Packet, controls []ldap.Control) []fakeResponse {
+		baseDN := req.Children[0].Value.(string)
+		filter, err := ldap.DecompileFilter(req.Children[6])
+		if err != nil {
+			t.Error(err)
+		}
+		mu.Lock()
+		searched = append(searched, baseDN)
+		mu.Unlock()
+		var resps []fakeResponse
+		for _, dn := range entries[baseDN] {
+			uid := strings.TrimPrefix(strings.SplitN(dn, ",", 2)[0], "uid=")
+			if filter == "(uid="+uid+")" {
+				resps = append(resps, fakeResponse{op: fakeEntry(dn, map[string][]string{"uid": {uid}, "mail": {uid + "@example.com"}})})
+			}
+		}
+		return append(resps, fakeResponse{op: fakeResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)})
+	})
+	defer stop()
+
+	c := testConfig()
+	c.Host = addr
+	c.InsecureNoSSL = true
+	c.UserSearch.IDAttr = "uid"
+	c.UserSearch.EmailAttr = "mail"
+	c.UserSearch.FallbackBaseDNs = []string{"ou=contractors,dc=example,dc=com", "ou=external,dc=example,dc=com"}
+	conn, err := c.OpenConnector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lc := conn.(*ldapConnector)
+
+	tests := []struct {
+		username  string
+		wantDN    string
+		wantFound bool
+		wantErr   bool
+		// Base DNs searched, after the primary one.
+		wantFallbacks int
+	}{
+		{username: "jane", wantDN: "uid=jane,ou=people,dc=example,dc=com", wantFound: true},
+		{username: "alice", wantDN: "uid=alice,ou=external,dc=example,dc=com", wantFound: true, wantFallbacks: 2},
+		// Multiple matches under a fallback base DN don't fall through to the
+		// next one.
+		{username: "bob", wantErr: true, wantFallbacks: 1},
+		{username: "john", wantFallbacks: 2},
+	}
+	for _, test := range tests {
+		mu.Lock()
+		searched = nil
+		mu.Unlock()
+		var (
+			user  ldap.Entry
+			found bool
+		)
+		err := lc.do(context.Background(), func(conn *ldap.Conn) error {
+			var err error
+			user, found, err = lc.userEntry(context.Background(), conn, test.username)
+			return err
+		})
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: want error %t, got %v", test.username, test.wantErr, err)
+			continue
+		}
+		if found != test.wantFound || user.DN != test.wantDN {
+			t.Errorf("%s: want found=%t dn=%q, got found=%t dn=%q", test.username, test.wantFound, test.wantDN, found, user.DN)
+		}
+		mu.Lock()
+		want := append([]string{c.UserSearch.BaseDN}, c.UserSearch.FallbackBaseDNs[:test.wantFallbacks]...)
+		if !reflect.DeepEqual(searched, want) {
+			t.Errorf("%s: want base DNs searched %q, got %q", test.username, want, searched)
+		}
+		mu.Unlock()
+	}
+}
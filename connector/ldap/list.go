@@ -0,0 +1,111 @@
+package ldap
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/net/context"
+	"gopkg.in/ldap.v2"
+
+	"github.com/coreos/dex/connector"
+)
+
+// listUsersPageSize is the number of user entries requested per page by
+// ListUsers.
+const listUsersPageSize = 500
+
+// ListUsers calls fn with the identity of every user under userSearch.baseDN
+// matching userSearch.filter and the additional filter, if not empty, for
+// provisioning tools that need to sync users from the directory. Users that
+// aren't allowed to log in, because they're deactivated, not in a required
+// group, or excluded by allowedUsers or deniedUsers, are skipped, as are
+// entries whose identity can't be resolved, such as those missing required
+// attributes or whose groups can't be queried. Skipped entries are logged.
+// Groups are only queried if s.Groups is set. Each user's username is the value of the first userSearch.username
+// attribute their entry has, so listing isn't available with
+// userSearch.filterTemplate.
+//
+// Entries are requested in pages over a dedicated connection, and the
+// userSearch size and time limits apply to the whole listing. Returning an
+// error from fn stops the listing and returns the error.
+//
+// ListUsers fails unless allowUserListing is set.
+func (c *ldapConnector) ListUsers(ctx context.Context, s connector.Scopes, filter string, fn func(connector.Identity) error) error {
+	if !c.AllowUserListing {
+		return errors.New("ldap: listing users requires allowUserListing to be set")
+	}
+	if c.userBaseDN != nil || c.UserSearch.BaseDN == "" {
+		return errors.New("ldap: listing users requires userSearch.baseDN without a username template")
+	}
+	if c.userFilter != nil {
+		// There's no attribute to read the username of each entry from.
+		return errors.New("ldap: listing users requires userSearch.username rather than userSearch.filterTemplate")
+	}
+	if filter != "" {
+		if _, err := ldap.CompileFilter(filter); err != nil {
+			return fmt.Errorf("ldap: parse filter: %v", err)
+		}
+	}
+	filter = c.excludeUsers(c.listUsersFilter(filter))
+
+	paging := ldap.NewControlPaging(listUsersPageSize)
+	req := &ldap.SearchRequest{
+		BaseDN:       c.UserSearch.BaseDN,
+		Filter:       filter,
+		Scope:        c.userSearchScope,
+		DerefAliases: c.derefAliases,
+		SizeLimit:    c.UserSearch.SizeLimit,
+		TimeLimit:    c.UserSearch.TimeLimit,
+		Attributes:   c.userAttributes(),
+		Controls:     []ldap.Control{paging},
+	}
+
+	// A dedicated connection keeps the paging cookie valid between pages, and
+	// lets the identities of each page be resolved over other connections
+	// without holding the persistent one.
+	conn, err := c.connectAny(ctx, true)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	for {
+		resp, err := c.search(ctx, conn, req)
+		if err != nil {
+			return err
+		}
+		for _, entry := range resp.Entries {
+			ident, ok, err := c.identityForUser(ctx, s, c.entryUsername(*entry), *entry)
+			if err != nil {
+				// One incomplete entry shouldn't stop the sync of the others.
+				c.logf(ctx, "%v, skipping", err)
+				continue
+			}
+			if !ok {
+				continue
+			}
+			if err := fn(ident); err != nil {
+				return err
+			}
+		}
+
+		control, ok := ldap.FindControl(resp.Controls, ldap.ControlTypePaging).(*ldap.ControlPaging)
+		if !ok || len(control.Cookie) == 0 {
+			return nil
+		}
+		paging.SetCookie(control.Cookie)
+	}
+}
+
+// listUsersFilter combines userSearch.filter with filter.
+func (c *ldapConnector) listUsersFilter(filter string) string {
+	switch {
+	case c.UserSearch.Filter != "" && filter != "":
+		return fmt.Sprintf("(&%s%s)", c.UserSearch.Filter, filter)
+	case c.UserSearch.Filter != "":
+		return c.UserSearch.Filter
+	case filter != "":
+		return filter
+	}
+	return "(objectClass=*)"
+}
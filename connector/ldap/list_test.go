@@ -0,0 +1,106 @@
+package ldap
+
+import (
+	"reflect"
+	"testing"
+
+	"golang.org/x/net/context"
+	"gopkg.in/asn1-ber.v1"
+	"gopkg.in/ldap.v2"
+
+	"github.com/coreos/dex/connector"
+)
+
+func TestListUsers(t *testing.T) {
+	var filters []string
+	addr, stop := fakeServer(t, func(req *ber.Packet, controls []ldap.Control) []fakeResponse {
+		filter, err := ldap.DecompileFilter(req.Children[6])
+		if err != nil {
+			t.Errorf("decompile filter: %v", err)
+		}
+		filters = append(filters, filter)
+		paging, ok := ldap.FindControl(controls, ldap.ControlTypePaging).(*ldap.ControlPaging)
+		if !ok {
+			t.Errorf("expected paging control")
+			return []fakeResponse{{op: fakeResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultOperationsError)}}
+		}
+		if string(paging.Cookie) == "" {
+			return []fakeResponse{
+				{op: fakeEntry("uid=jane,ou=people,dc=example,dc=com", map[string][]string{"uid": {"jane"}, "mail": {"jane@example.com"}, "gidNumber": {"100"}})},
+				// Missing an email, skipped.
+				{op: fakeEntry("uid=svc,ou=people,dc=example,dc=com", map[string][]string{"uid": {"svc"}})},
+				{
+					op:       fakeResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess),
+					controls: []ldap.Control{&ldap.ControlPaging{Cookie: []byte("page2")}},
+				},
+			}
+		}
+		return []fakeResponse{
+			// Missing the groupSearch.userAttr required by requireUserAttr, skipped.
+			{op: fakeEntry("uid=bob,ou=people,dc=example,dc=com", map[string][]string{"uid": {"bob"}, "mail": {"bob@example.com"}})},
+			{op: fakeEntry("uid=john,ou=people,dc=example,dc=com", map[string][]string{"uid": {"john"}, "mail": {"john@example.com"}, "gidNumber": {"100"}})},
+			{
+				op:       fakeResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess),
+				controls: []ldap.Control{&ldap.ControlPaging{}},
+			},
+		}
+	})
+	defer stop()
+
+	c := testConfig()
+	c.Host = addr
+	c.InsecureNoSSL = true
+	c.UserSearch.Filter = "(objectClass=person)"
+	c.UserSearch.IDAttr = "uid"
+	c.UserSearch.EmailAttr = "mail"
+	// The entries have no employeeNumber, so their usernames are read from uid.
+	c.UserSearch.Username = StringList{"employeeNumber", "uid"}
+	c.AllowedUsers = []string{"jane", "bob", "john"}
+	c.GroupSearch.BaseDN = "ou=groups,dc=example,dc=com"
+	c.GroupSearch.UserAttr = "gidNumber"
+	c.GroupSearch.GroupAttr = "gidNumber"
+	c.GroupSearch.NameAttr = "cn"
+	c.GroupSearch.RequireUserAttr = true
+	conn, err := c.OpenConnector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lc := conn.(*ldapConnector)
+	list := func(ident connector.Identity) error { return nil }
+	if err := lc.ListUsers(context.Background(), connector.Scopes{}, "", list); err == nil {
+		t.Errorf("expected error without allowUserListing")
+	}
+
+	lc.AllowUserListing = true
+	var emails []string
+	err = lc.ListUsers(context.Background(), connector.Scopes{}, "(departmentNumber=42)", func(ident connector.Identity) error {
+		emails = append(emails, ident.Email)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"jane@example.com", "john@example.com"}; !reflect.DeepEqual(emails, want) {
+		t.Errorf("want=%q, got=%q", want, emails)
+	}
+	wantFilters := []string{"(&(objectClass=person)(departmentNumber=42))", "(&(objectClass=person)(departmentNumber=42))"}
+	if !reflect.DeepEqual(filters, wantFilters) {
+		t.Errorf("want=%q, got=%q", wantFilters, filters)
+	}
+
+	if err := lc.ListUsers(context.Background(), connector.Scopes{}, "(departmentNumber=42", list); err == nil {
+		t.Errorf("expected error for invalid filter")
+	}
+
+	c.AllowUserListing = true
+	c.UserSearch.Username = nil
+	c.UserSearch.Filter = ""
+	c.UserSearch.FilterTemplate = "(|(uid={{.Username}})(mail={{.Username}}))"
+	conn, err = c.OpenConnector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.(*ldapConnector).ListUsers(context.Background(), connector.Scopes{}, "", list); err == nil {
+		t.Errorf("expected error with a filter template")
+	}
+}
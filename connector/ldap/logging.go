@@ -0,0 +1,58 @@
+package ldap
+
+import (
+	"fmt"
+	"log"
+
+	"golang.org/x/net/context"
+)
+
+// Logger receives the connector's log messages. *log.Logger satisfies it, as
+// do most structured loggers.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+type stdLogger struct{}
+
+func (stdLogger) Printf(format string, v ...interface{}) { log.Printf(format, v...) }
+
+// WithLogger configures the connector to write log messages to l instead of
+// the standard logger.
+func WithLogger(l Logger) Option {
+	return func(c *ldapConnector) { c.logger = l }
+}
+
+// WithRequestIDFunc configures how the connector finds the ID of the request
+// a context belongs to, for callers that already carry one in their contexts.
+// By default the ID set by ContextWithRequestID is used.
+func WithRequestIDFunc(f func(ctx context.Context) string) Option {
+	return func(c *ldapConnector) { c.requestID = f }
+}
+
+type requestIDKey struct{}
+
+// ContextWithRequestID returns a context carrying the ID of the request it
+// belongs to. Log messages emitted by the connector while handling the
+// request include the ID, so they can be correlated with the caller's logs.
+func ContextWithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// logf logs a message, appending the ID of the request ctx belongs to, if any,
+// and the name of the directory in a MultiConfig.
+func (c *ldapConnector) logf(ctx context.Context, format string, v ...interface{}) {
+	msg := fmt.Sprintf(format, v...)
+	if c.directory != "" {
+		msg += " directory=" + c.directory
+	}
+	if id := c.requestID(ctx); id != "" {
+		msg += " request_id=" + id
+	}
+	c.logger.Printf("%s", msg)
+}
@@ -0,0 +1,207 @@
+package ldap
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+	"gopkg.in/asn1-ber.v1"
+	"gopkg.in/ldap.v2"
+
+	"github.com/coreos/dex/connector"
+)
+
+func TestLogRequestID(t *testing.T) {
+	addr, stop := fakeServer(t, func(req *ber.Packet, controls []ldap.Control) []fakeResponse {
+		return []fakeResponse{{op: fakeResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)}}
+	})
+	defer stop()
+
+	c := testConfig()
+	c.Host = addr
+	c.InsecureNoSSL = true
+
+	var buf bytes.Buffer
+	conn, err := c.OpenConnector(WithLogger(log.New(&buf, "", 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := ContextWithRequestID(context.Background(), "abc123")
+	if _, valid, err := conn.Login(ctx, connector.Scopes{}, "jane", "secret"); err != nil || valid {
+		t.Fatalf("expected invalid credentials, got valid=%t err=%v", valid, err)
+	}
+	if got := buf.String(); !strings.Contains(got, "no results returned") || !strings.Contains(got, "request_id=abc123") {
+		t.Errorf("expected log message with request ID, got %q", got)
+	}
+
+	type traceKey struct{}
+	buf.Reset()
+	conn, err = c.OpenConnector(
+		WithLogger(log.New(&buf, "", 0)),
+		WithRequestIDFunc(func(ctx context.Context) string {
+			id, _ := ctx.Value(traceKey{}).(string)
+			return id
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx = context.WithValue(context.Background(), traceKey{}, "trace-1")
+	if _, _, err := conn.Login(ctx, connector.Scopes{}, "jane", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if got := buf.String(); !strings.Contains(got, "request_id=trace-1") {
+		t.Errorf("expected log message with trace ID, got %q", got)
+	}
+}
+
+func TestLogBindDiagnosticMessage(t *testing.T) {
+	const (
+		badPassword = "80090308: LdapErr: DSID-0C09042A, comment: AcceptSecurityContext error, data 52e, v3839"
+		unwilling   = "00002035: LdapErr: DSID-0C090F37, comment: password change required"
+	)
+	addr, stop := fakeServerBinds(t, func(dn, password string) *ber.Packet {
+		switch password {
+		case "wrong":
+			return fakeResultMessage(ldap.ApplicationBindResponse, ldap.LDAPResultInvalidCredentials, badPassword)
+		case "expired":
+			return fakeResultMessage(ldap.ApplicationBindResponse, ldap.LDAPResultUnwillingToPerform, unwilling)
+		}
+		return fakeResult(ldap.ApplicationBindResponse, ldap.LDAPResultSuccess)
+	}, func(boundDN string, req *ber.Packet, controls []ldap.Control) []fakeResponse {
+		return []fakeResponse{
+			{op: fakeEntry("uid=jane,ou=people,dc=example,dc=com", map[string][]string{"uid": {"jane"}, "mail": {"jane@example.com"}})},
+			{op: fakeResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)},
+		}
+	})
+	defer stop()
+
+	c := testConfig()
+	c.Host = addr
+	c.InsecureNoSSL = true
+	c.UserSearch.IDAttr = "uid"
+	c.UserSearch.EmailAttr = "mail"
+
+	var buf bytes.Buffer
+	conn, err := c.OpenConnector(WithLogger(log.New(&buf, "", 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, valid, err := conn.Login(context.Background(), connector.Scopes{}, "jane", "wrong"); err != nil || valid {
+		t.Fatalf("expected invalid credentials, got valid=%t err=%v", valid, err)
+	}
+	if got := buf.String(); !strings.Contains(got, "data 52e") {
+		t.Errorf("expected the server's diagnostic message in the log, got %q", got)
+	}
+
+	// By default unwillingToPerform is an account problem refusing the login.
+	buf.Reset()
+	if _, valid, err := conn.Login(context.Background(), connector.Scopes{}, "jane", "expired"); err != nil || valid {
+		t.Fatalf("expected account problem to refuse the login, got valid=%t err=%v", valid, err)
+	}
+	if got := buf.String(); !strings.Contains(got, "account can't log in") || !strings.Contains(got, unwilling) {
+		t.Errorf("expected the account problem and diagnostic message in the log, got %q", got)
+	}
+
+	c.BindResultCodes.AccountProblem = []int{ldap.LDAPResultConstraintViolation}
+	if conn, err = c.OpenConnector(WithLogger(log.New(&buf, "", 0))); err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = conn.Login(context.Background(), connector.Scopes{}, "jane", "expired")
+	if err == nil {
+		t.Fatal("expected error for a bind the server was unwilling to perform")
+	}
+	if !isResultCode(err, ldap.LDAPResultUnwillingToPerform) || diagnosticMessage(err) != unwilling {
+		t.Errorf("expected error wrapping the server's diagnostic message, got %v", err)
+	}
+}
+
+func TestLogUserNotFound(t *testing.T) {
+	addr, stop := fakeServer(t, func(req *ber.Packet, controls []ldap.Control) []fakeResponse {
+		return []fakeResponse{{op: fakeResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)}}
+	})
+	defer stop()
+
+	for _, onNotFound := range []string{onNotFoundFail, onNotFoundLog} {
+		c := testConfig()
+		c.Host = addr
+		c.InsecureNoSSL = true
+		c.UserSearch.OnNotFound = onNotFound
+
+		var buf bytes.Buffer
+		conn, err := c.OpenConnector(WithLogger(log.New(&buf, "", 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The response must be the same either way.
+		if _, valid, err := conn.Login(context.Background(), connector.Scopes{}, "jane", "secret"); err != nil || valid {
+			t.Errorf("%s: expected invalid credentials, got valid=%t err=%v", onNotFound, valid, err)
+		}
+		logged := strings.Contains(buf.String(), ErrUserNotFound.Error())
+		if want := onNotFound == onNotFoundLog; logged != want {
+			t.Errorf("%s: want user not found logged=%t, got log %q", onNotFound, want, buf.String())
+		}
+	}
+
+	c := testConfig()
+	c.UserSearch.OnNotFound = "error"
+	if _, err := c.OpenConnector(); err == nil {
+		t.Errorf("expected error for unknown userSearch.onNotFound value")
+	}
+}
+
+func TestLogEntry(t *testing.T) {
+	addr, stop := fakeServer(t, func(req *ber.Packet, controls []ldap.Control) []fakeResponse {
+		return []fakeResponse{
+			{op: fakeEntry("uid=jane,ou=people,dc=example,dc=com", map[string][]string{
+				"uid":          {"jane"},
+				"mail":         {"jane@example.com"},
+				"memberOf":     {"cn=admins,ou=groups,dc=example,dc=com", "cn=ops,ou=groups,dc=example,dc=com"},
+				"userPassword": {"{SSHA}c2VjcmV0"},
+				"homePhone":    {"555-0100"},
+			})},
+			{op: fakeResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)},
+		}
+	})
+	defer stop()
+
+	tests := []struct {
+		logEntry string
+		want     string
+		hidden   string
+	}{
+		{"", "", "memberOf"},
+		{logEntryAttributes, "mail (1), memberOf (2), uid (1)", "jane@example.com"},
+		{logEntryValues, `mail=["jane@example.com"]`, ""},
+		{logEntryValues, "userPassword (1, REDACTED)", "c2VjcmV0"},
+		{logEntryValues, "homePhone (1, REDACTED)", "555-0100"},
+	}
+	for _, tc := range tests {
+		c := testConfig()
+		c.Host = addr
+		c.InsecureNoSSL = true
+		c.UserSearch.IDAttr = "uid"
+		c.UserSearch.EmailAttr = "mail"
+		c.UserSearch.LogEntry = tc.logEntry
+		c.PreviewRedactAttributes = []string{"homephone"}
+
+		var buf bytes.Buffer
+		conn, err := c.OpenConnector(WithLogger(log.New(&buf, "", 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, valid, err := conn.Login(context.Background(), connector.Scopes{}, "jane", "secret"); err != nil || !valid {
+			t.Fatalf("%q: expected valid login, got valid=%t err=%v", tc.logEntry, valid, err)
+		}
+		got := buf.String()
+		if !strings.Contains(got, tc.want) {
+			t.Errorf("%q: expected log to contain %q, got %q", tc.logEntry, tc.want, got)
+		}
+		if tc.hidden != "" && strings.Contains(got, tc.hidden) {
+			t.Errorf("%q: expected log not to contain %q, got %q", tc.logEntry, tc.hidden, got)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package ldap
+
+import (
+	"errors"
+	"time"
+
+	"gopkg.in/ldap.v2"
+)
+
+// Operations reported to Metrics.
+const (
+	OpDial   = "dial"
+	OpBind   = "bind"
+	OpSearch = "search"
+)
+
+// Failure types reported to Metrics. An empty failure type indicates the
+// operation succeeded.
+const (
+	FailureConnection = "connection"
+	FailureAuth       = "auth"
+	FailureSearch     = "search"
+)
+
+// Metrics receives instrumentation about the LDAP operations performed by the
+// connector, letting callers export latencies and failure rates through a
+// library such as Prometheus. Counts of connections, binds, and searches can
+// be derived by counting observations of each operation.
+//
+// Implementations must be safe for concurrent use.
+type Metrics interface {
+	// ObserveOperation is called once an operation completes. failure is empty
+	// if the operation succeeded.
+	ObserveOperation(op string, latency time.Duration, failure string)
+}
+
+type noopMetrics struct{}
+
+func (noopMetrics) ObserveOperation(op string, latency time.Duration, failure string) {}
+
+// Option customizes a connector returned by OpenConnector.
+type Option func(c *ldapConnector)
+
+// WithMetrics configures the connector to report operations to the provided
+// Metrics.
+func WithMetrics(m Metrics) Option {
+	return func(c *ldapConnector) { c.metrics = m }
+}
+
+// observe reports the latency and outcome of an operation started at start.
+// failure is only used if err is non-nil.
+func (c *ldapConnector) observe(op string, start time.Time, err error, failure string) {
+	if err == nil {
+		failure = ""
+	} else if isNetworkError(err) {
+		failure = FailureConnection
+	}
+	c.metrics.ObserveOperation(op, time.Since(start), failure)
+}
+
+// isNetworkError reports if an error returned by the ldap library was caused
+// by the underlying connection rather than the server's response.
+func isNetworkError(err error) bool {
+	return isResultCode(err, ldap.ErrorNetwork)
+}
+
+// isResultCode reports if err wraps an ldap library error with the given
+// result code.
+func isResultCode(err error, code uint8) bool {
+	var ldapErr *ldap.Error
+	return errors.As(err, &ldapErr) && ldapErr.ResultCode == code
+}
+
+// diagnosticMessage returns the diagnostic message the server returned with
+// an error, such as Active Directory's "data 52e" codes explaining why a bind
+// was rejected, or "" if there's none.
+func diagnosticMessage(err error) string {
+	var ldapErr *ldap.Error
+	if !errors.As(err, &ldapErr) || ldapErr.Err == nil {
+		return ""
+	}
+	return ldapErr.Err.Error()
+}
@@ -0,0 +1,89 @@
+package ldap
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"gopkg.in/asn1-ber.v1"
+	"gopkg.in/ldap.v2"
+
+	"github.com/coreos/dex/connector"
+)
+
+// recordingMetrics records the operations and failures it observes.
+type recordingMetrics struct {
+	mu  sync.Mutex
+	ops []string
+}
+
+func (m *recordingMetrics) ObserveOperation(op string, latency time.Duration, failure string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if failure != "" {
+		op += ":" + failure
+	}
+	m.ops = append(m.ops, op)
+}
+
+func (m *recordingMetrics) observed() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ops := m.ops
+	m.ops = nil
+	return ops
+}
+
+func TestMetrics(t *testing.T) {
+	addr, stop := fakeServerBinds(t, func(dn, password string) *ber.Packet {
+		if dn != "" && password != "password" {
+			return fakeResult(ldap.ApplicationBindResponse, ldap.LDAPResultInvalidCredentials)
+		}
+		return fakeResult(ldap.ApplicationBindResponse, ldap.LDAPResultSuccess)
+	}, func(boundDN string, req *ber.Packet, controls []ldap.Control) []fakeResponse {
+		return []fakeResponse{
+			{op: fakeEntry("uid=jane,ou=people,dc=example,dc=com", map[string][]string{"uid": {"jane"}, "mail": {"jane@example.com"}})},
+			{op: fakeResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)},
+		}
+	})
+	defer stop()
+
+	c := testConfig()
+	c.Host = addr
+	c.InsecureNoSSL = true
+	c.UserSearch.IDAttr = "uid"
+	c.UserSearch.EmailAttr = "mail"
+
+	m := new(recordingMetrics)
+	conn, err := c.OpenConnector(WithMetrics(m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	tests := []struct {
+		password string
+		want     []string
+	}{
+		{"password", []string{OpDial, OpBind, OpSearch, OpBind}},
+		{"wrong", []string{OpDial, OpBind, OpSearch, OpBind + ":" + FailureAuth}},
+	}
+	for _, test := range tests {
+		if _, _, err := conn.Login(context.Background(), connector.Scopes{}, "jane", test.password); err != nil {
+			t.Fatalf("password %q: %v", test.password, err)
+		}
+		if got := m.observed(); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("password %q: want operations %q, got %q", test.password, test.want, got)
+		}
+	}
+
+	stop()
+	if _, _, err := conn.Login(context.Background(), connector.Scopes{}, "jane", "password"); err == nil {
+		t.Fatal("expected login to fail with the server stopped")
+	}
+	if got, want := m.observed(), []string{OpDial + ":" + FailureConnection}; !reflect.DeepEqual(got, want) {
+		t.Errorf("want operations %q, got %q", want, got)
+	}
+}
@@ -0,0 +1,151 @@
+package ldap
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/dex/connector"
+)
+
+// MultiConfig configures a connector for users split across several
+// independent directories, such as after a merger. Unlike failover hosts,
+// each directory is authoritative for its own users: a login is checked
+// against the first directory, in order, with an entry for the username, and
+// the user's groups come from that directory.
+//
+// Directories using userSearch.bindDNTemplate can't tell a missing user from
+// a wrong password, so the following directories are tried after a failed
+// bind. If a directory returns an error, or holds the user but refuses them,
+// for example through deniedUsers, the login fails rather than checking the
+// password against a user of the same name in the next directory.
+//
+// User IDs are prefixed with the name of the directory and a colon, such as
+// "b:1234", so users with the same ID in different directories are given
+// different subjects.
+type MultiConfig struct {
+	// The directories, in the order they're searched for users.
+	Directories []Directory `json:"directories"`
+}
+
+// Directory is one of the directories of a MultiConfig.
+type Directory struct {
+	// Identifies the directory in the connector data of the identities it
+	// authenticated, so refreshes go to the same directory. Names must be
+	// unique and shouldn't change while users are logged in.
+	Name string `json:"name"`
+
+	Config
+}
+
+// Open returns a connector searching the directories in order.
+func (c *MultiConfig) Open() (connector.Connector, error) {
+	conn, err := c.OpenConnector()
+	if err != nil {
+		return nil, err
+	}
+	return connector.Connector(conn), nil
+}
+
+// OpenConnector is the same as Open but returns a type with all implemented
+// connector interfaces. The options apply to every directory.
+func (c *MultiConfig) OpenConnector(opts ...Option) (interface {
+	connector.Connector
+	connector.PasswordConnector
+	connector.RefreshConnector
+	io.Closer
+}, error) {
+	if len(c.Directories) == 0 {
+		return nil, errors.New("ldap: missing required field \"directories\"")
+	}
+	m := &multiConnector{byName: make(map[string]*ldapConnector, len(c.Directories))}
+	for i, d := range c.Directories {
+		if d.Name == "" {
+			m.Close()
+			return nil, fmt.Errorf("ldap: directories[%d]: missing required field \"name\"", i)
+		}
+		if _, ok := m.byName[d.Name]; ok {
+			m.Close()
+			return nil, fmt.Errorf("ldap: directories[%d]: duplicate name %q", i, d.Name)
+		}
+		conn, err := d.Config.OpenConnector(append(opts[:len(opts):len(opts)], withDirectory(d.Name))...)
+		if err != nil {
+			m.Close()
+			return nil, fmt.Errorf("ldap: directory %q: %w", d.Name, err)
+		}
+		lc := conn.(*ldapConnector)
+		m.dirs = append(m.dirs, lc)
+		m.byName[d.Name] = lc
+	}
+	return m, nil
+}
+
+// withDirectory names the directory of a connector opened from a MultiConfig.
+func withDirectory(name string) Option {
+	return func(c *ldapConnector) { c.directory = name }
+}
+
+type multiConnector struct {
+	// The directories in search order.
+	dirs   []*ldapConnector
+	byName map[string]*ldapConnector
+}
+
+// Login authenticates the user against the first directory holding them.
+func (m *multiConnector) Login(ctx context.Context, s connector.Scopes, username, password string) (connector.Identity, bool, error) {
+	if password == "" {
+		// Every directory refuses an empty password before searching, see
+		// ldapConnector.login, so there's no need to try each of them.
+		return connector.Identity{}, false, nil
+	}
+	for _, d := range m.dirs {
+		ident, validPass, found, err := d.login(ctx, s, username, password)
+		if err != nil {
+			return connector.Identity{}, false, fmt.Errorf("ldap: directory %q: %w", d.directory, err)
+		}
+		if found {
+			return ident, validPass, nil
+		}
+	}
+	return connector.Identity{}, false, nil
+}
+
+// LookupIdentity returns the identity of the user from the first directory
+// holding them. It fails unless allowIdentityLookup is set for each
+// directory searched.
+func (m *multiConnector) LookupIdentity(ctx context.Context, s connector.Scopes, username string) (connector.Identity, bool, error) {
+	for _, d := range m.dirs {
+		ident, ok, found, err := d.lookupIdentity(ctx, s, username)
+		if err != nil {
+			return connector.Identity{}, false, fmt.Errorf("ldap: directory %q: %w", d.directory, err)
+		}
+		if found {
+			return ident, ok, nil
+		}
+	}
+	return connector.Identity{}, false, nil
+}
+
+// Refresh refreshes the identity against the directory that authenticated
+// the user.
+func (m *multiConnector) Refresh(ctx context.Context, s connector.Scopes, ident connector.Identity) (connector.Identity, error) {
+	var data ConnectorData
+	if err := json.Unmarshal(ident.ConnectorData, &data); err != nil {
+		return ident, fmt.Errorf("ldap: failed to unmarshal internal data: %v", err)
+	}
+	d, ok := m.byName[data.Directory]
+	if !ok {
+		return ident, fmt.Errorf("ldap: identity of user %q is from unknown directory %q", data.Username, data.Directory)
+	}
+	return d.Refresh(ctx, s, ident)
+}
+
+func (m *multiConnector) Close() error {
+	for _, d := range m.dirs {
+		d.Close()
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package ldap
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/net/context"
+	"gopkg.in/asn1-ber.v1"
+	"gopkg.in/ldap.v2"
+
+	"github.com/coreos/dex/connector"
+)
+
+// fakeDirectory serves a directory holding a single user with the password
+// "secret", and counts the searches it receives.
+func fakeDirectory(t *testing.T, uid string) (addr string, searches func() int, stop func()) {
+	var (
+		mu    sync.Mutex
+		count int
+	)
+	dn := "uid=" + uid + ",ou=people,dc=example,dc=com"
+	addr, stop = fakeServerBinds(t, func(bindDN, password string) *ber.Packet {
+		if bindDN != "" && (bindDN != dn || password != "secret") {
+			return fakeResult(ldap.ApplicationBindResponse, ldap.LDAPResultInvalidCredentials)
+		}
+		return fakeResult(ldap.ApplicationBindResponse, ldap.LDAPResultSuccess)
+	}, func(boundDN string, req *ber.Packet, controls []ldap.Control) []fakeResponse {
+		mu.Lock()
+		count++
+		mu.Unlock()
+		filter, err := ldap.DecompileFilter(req.Children[6])
+		if err != nil || !strings.Contains(filter, "(uid="+uid+")") {
+			return []fakeResponse{{op: fakeResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)}}
+		}
+		return []fakeResponse{
+			{op: fakeEntry(dn, map[string][]string{"uid": {uid}, "mail": {uid + "@example.com"}})},
+			{op: fakeResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)},
+		}
+	})
+	return addr, func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return count
+	}, stop
+}
+
+func TestMultiConfig(t *testing.T) {
+	addrA, searchesA, stopA := fakeDirectory(t, "jane")
+	defer stopA()
+	addrB, searchesB, stopB := fakeDirectory(t, "bob")
+	defer stopB()
+
+	directory := func(name, addr string) Directory {
+		c := testConfig()
+		c.Host = addr
+		c.InsecureNoSSL = true
+		c.UserSearch.IDAttr = "uid"
+		c.UserSearch.EmailAttr = "mail"
+		return Directory{Name: name, Config: *c}
+	}
+	m := &MultiConfig{Directories: []Directory{directory("a", addrA), directory("b", addrB)}}
+	conn, err := m.OpenConnector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	s := connector.Scopes{OfflineAccess: true}
+	ident, valid, err := conn.Login(context.Background(), s, "bob", "secret")
+	if err != nil || !valid {
+		t.Fatalf("expected bob to log in through the second directory, got valid=%t err=%v", valid, err)
+	}
+	var data ConnectorData
+	if err := json.Unmarshal(ident.ConnectorData, &data); err != nil {
+		t.Fatal(err)
+	}
+	if data.Directory != "b" {
+		t.Errorf("expected connector data from directory %q, got %q", "b", data.Directory)
+	}
+	if ident.UserID != "b:bob" {
+		t.Errorf("expected user ID prefixed with the directory name, got %q", ident.UserID)
+	}
+	if _, err := conn.Refresh(context.Background(), s, ident); err != nil {
+		t.Errorf("refresh: %v", err)
+	}
+
+	// jane is only in the first directory, which is authoritative for her.
+	before := searchesB()
+	if _, valid, err := conn.Login(context.Background(), connector.Scopes{}, "jane", "wrong"); err != nil || valid {
+		t.Errorf("expected invalid credentials for jane, got valid=%t err=%v", valid, err)
+	}
+	if searchesB() != before {
+		t.Errorf("expected the second directory not to be searched for a user found in the first")
+	}
+	if searchesA() == 0 {
+		t.Errorf("expected the first directory to be searched")
+	}
+
+	if _, valid, err := conn.Login(context.Background(), connector.Scopes{}, "alice", "secret"); err != nil || valid {
+		t.Errorf("expected invalid credentials for an unknown user, got valid=%t err=%v", valid, err)
+	}
+
+	data.Directory = "c"
+	ident.ConnectorData, _ = json.Marshal(data)
+	if _, err := conn.Refresh(context.Background(), s, ident); err == nil {
+		t.Errorf("expected refresh of an identity from an unknown directory to fail")
+	}
+
+	m.Directories[1].Name = "a"
+	if _, err := m.OpenConnector(); err == nil {
+		t.Errorf("expected error for duplicate directory names")
+	}
+}
+
+func TestMultiConfigRefusedUser(t *testing.T) {
+	addrA, _, stopA := fakeDirectory(t, "jane")
+	defer stopA()
+	addrB, searchesB, stopB := fakeDirectory(t, "jane")
+	defer stopB()
+
+	directory := func(name, addr string) Directory {
+		c := testConfig()
+		c.Host = addr
+		c.InsecureNoSSL = true
+		c.UserSearch.IDAttr = "uid"
+		c.UserSearch.EmailAttr = "mail"
+		c.AllowIdentityLookup = true
+		return Directory{Name: name, Config: *c}
+	}
+	m := &MultiConfig{Directories: []Directory{directory("a", addrA), directory("b", addrB)}}
+	m.Directories[0].DeniedUsers = []string{"jane"}
+	conn, err := m.OpenConnector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Refused by the first directory, which holds her, rather than logged in
+	// as the jane of the second.
+	if _, valid, err := conn.Login(context.Background(), connector.Scopes{}, "jane", "secret"); err != nil || valid {
+		t.Errorf("expected jane to be refused, got valid=%t err=%v", valid, err)
+	}
+	lookup := conn.(interface {
+		LookupIdentity(ctx context.Context, s connector.Scopes, username string) (connector.Identity, bool, error)
+	})
+	if _, found, err := lookup.LookupIdentity(context.Background(), connector.Scopes{}, "jane"); err != nil || found {
+		t.Errorf("expected jane's lookup to be refused, got found=%t err=%v", found, err)
+	}
+	if n := searchesB(); n != 0 {
+		t.Errorf("expected the second directory not to be searched, got %d searches", n)
+	}
+
+	// The same user ID in different directories gives different subjects.
+	m.Directories[0].DeniedUsers = nil
+	if conn, err = m.OpenConnector(); err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ident, valid, err := conn.Login(context.Background(), connector.Scopes{}, "jane", "secret")
+	if err != nil || !valid {
+		t.Fatalf("expected jane to log in, got valid=%t err=%v", valid, err)
+	}
+	if ident.UserID != "a:jane" {
+		t.Errorf("expected user ID %q, got %q", "a:jane", ident.UserID)
+	}
+}
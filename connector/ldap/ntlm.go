@@ -0,0 +1,310 @@
+package ldap
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"golang.org/x/crypto/md4"
+	"gopkg.in/asn1-ber.v1"
+	"gopkg.in/ldap.v2"
+)
+
+// Like SASL EXTERNAL, NTLM binds aren't supported by the ldap library and are
+// written directly to the network connection before it's handed off to it.
+//
+// Active Directory accepts NTLM through the "sicily" authentication choices
+// of the bind request, see [MS-ADTS] section 5.1.1.1.3. The client sends a
+// negotiate message, the server returns a challenge in the matchedDN field of
+// the bind response, and the client answers it in a second bind request. Only
+// NTLMv2 responses are produced, see [MS-NLMP]. If the challenge carries the
+// server's timestamp, as from Windows Server 2008 on, the response uses it and
+// includes a MIC, see [MS-NLMP] section 3.1.5.1.2.
+
+// Authentication choices of the bind request used for NTLM.
+const (
+	sicilyNegotiate = 10
+	sicilyResponse  = 11
+)
+
+// NTLM negotiate flags, see [MS-NLMP] section 2.2.2.5.
+const (
+	ntlmNegotiateUnicode                 = 0x00000001
+	ntlmRequestTarget                    = 0x00000004
+	ntlmNegotiateNTLM                    = 0x00000200
+	ntlmNegotiateAlwaysSign              = 0x00008000
+	ntlmNegotiateExtendedSessionSecurity = 0x00080000
+	ntlmNegotiateTargetInfo              = 0x00800000
+	ntlmNegotiate128                     = 0x20000000
+	ntlmNegotiate56                      = 0x80000000
+)
+
+// ntlmNegotiateFlags are the flags requested by the client.
+const ntlmNegotiateFlags uint32 = ntlmNegotiateUnicode | ntlmRequestTarget | ntlmNegotiateNTLM |
+	ntlmNegotiateAlwaysSign | ntlmNegotiateExtendedSessionSecurity | ntlmNegotiateTargetInfo |
+	ntlmNegotiate128 | ntlmNegotiate56
+
+var ntlmSignature = []byte("NTLMSSP\x00")
+
+// AV pair IDs of the challenge's target info, see [MS-NLMP] section 2.2.2.1.
+const (
+	msvAvEOL       = 0
+	msvAvFlags     = 6
+	msvAvTimestamp = 7
+)
+
+// msvAvFlagMIC is set in the MsvAvFlags AV pair when the authenticate message
+// has a MIC.
+const msvAvFlagMIC = 0x00000002
+
+// ntlmBind performs an NTLM bind as the user in domain.
+func ntlmBind(conn net.Conn, domain, username, password string) error {
+	negotiate := ntlmNegotiateMessage()
+	resp, err := rawRequest(conn, ntlmBindRequest(sicilyNegotiate, negotiate))
+	if err != nil {
+		return err
+	}
+	if tag := resp.Children[1].Tag; tag != ldap.ApplicationBindResponse {
+		return ldap.NewError(ldap.ErrorUnexpectedResponse, fmt.Errorf("ldap: expected bind response got tag %d", tag))
+	}
+	if err := rawResultCode(resp); err != nil {
+		return err
+	}
+	challenge, err := parseNTLMChallenge(resp.Children[1].Children[1].ByteValue)
+	if err != nil {
+		return ldap.NewError(ldap.ErrorUnexpectedResponse, err)
+	}
+
+	var clientChallenge [8]byte
+	if _, err := rand.Read(clientChallenge[:]); err != nil {
+		return fmt.Errorf("ldap: generate NTLM client challenge: %v", err)
+	}
+	msg, err := ntlmAuthenticateMessage(negotiate, challenge, domain, username, password, clientChallenge[:], ntlmTimestamp(time.Now()))
+	if err != nil {
+		return ldap.NewError(ldap.ErrorUnexpectedResponse, err)
+	}
+	resp, err = rawRequest(conn, ntlmBindRequest(sicilyResponse, msg))
+	if err != nil {
+		return err
+	}
+	if tag := resp.Children[1].Tag; tag != ldap.ApplicationBindResponse {
+		return ldap.NewError(ldap.ErrorUnexpectedResponse, fmt.Errorf("ldap: expected bind response got tag %d", tag))
+	}
+	return rawResultCode(resp)
+}
+
+func ntlmBindRequest(choice ber.Tag, msg []byte) *ber.Packet {
+	req := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationBindRequest, nil, "Bind Request")
+	req.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, 3, "Version"))
+	req.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "User Name"))
+	req.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, choice, string(msg), "NTLM Message"))
+	return req
+}
+
+// ntlmNegotiateMessage returns a negotiate message without a domain or
+// workstation, which are supplied in the authenticate message instead.
+func ntlmNegotiateMessage() []byte {
+	var b bytes.Buffer
+	b.Write(ntlmSignature)
+	binary.Write(&b, binary.LittleEndian, uint32(1))
+	binary.Write(&b, binary.LittleEndian, ntlmNegotiateFlags)
+	b.Write(make([]byte, 16)) // Empty domain and workstation fields.
+	return b.Bytes()
+}
+
+// ntlmChallenge holds the parts of a challenge message needed to answer it.
+type ntlmChallenge struct {
+	flags           uint32
+	serverChallenge []byte
+	targetInfo      []byte
+	// The whole message, which the MIC covers.
+	raw []byte
+}
+
+func parseNTLMChallenge(msg []byte) (*ntlmChallenge, error) {
+	if len(msg) < 48 || !bytes.Equal(msg[:8], ntlmSignature) || binary.LittleEndian.Uint32(msg[8:]) != 2 {
+		return nil, errors.New("ldap: server didn't return an NTLM challenge")
+	}
+	c := &ntlmChallenge{
+		flags:           binary.LittleEndian.Uint32(msg[20:]),
+		serverChallenge: msg[24:32],
+		raw:             msg,
+	}
+	n := int(binary.LittleEndian.Uint16(msg[40:]))
+	offset := int(binary.LittleEndian.Uint32(msg[44:]))
+	if offset > len(msg) || n > len(msg)-offset {
+		return nil, errors.New("ldap: malformed NTLM challenge")
+	}
+	c.targetInfo = msg[offset : offset+n]
+	return c, nil
+}
+
+// ntlmAuthenticateMessage answers a challenge with NTLMv2 and LMv2 responses.
+// If the challenge has the server's timestamp it's used instead of timestamp,
+// the LMv2 response is left empty and a MIC over the negotiate, challenge and
+// authenticate messages is added.
+func ntlmAuthenticateMessage(negotiate []byte, c *ntlmChallenge, domain, username, password string, clientChallenge []byte, timestamp uint64) ([]byte, error) {
+	targetInfo, serverTime, err := ntlmTargetInfo(c.targetInfo)
+	if err != nil {
+		return nil, err
+	}
+	mic := serverTime != nil
+	if mic {
+		timestamp = *serverTime
+	}
+
+	key := ntowfv2(domain, username, password)
+	nt, lm := ntlmv2Response(key, c.serverChallenge, clientChallenge, targetInfo, timestamp)
+	if mic {
+		lm = make([]byte, 24)
+	}
+
+	payload := [][]byte{lm, nt, utf16le(domain), utf16le(username), nil, nil}
+	// The fields, flags, an empty version and the MIC.
+	const (
+		micOffset = 72
+		headerLen = micOffset + 16
+	)
+
+	var b bytes.Buffer
+	b.Write(ntlmSignature)
+	binary.Write(&b, binary.LittleEndian, uint32(3))
+	offset := headerLen
+	for i, p := range payload {
+		binary.Write(&b, binary.LittleEndian, uint16(len(p)))
+		binary.Write(&b, binary.LittleEndian, uint16(len(p)))
+		binary.Write(&b, binary.LittleEndian, uint32(offset))
+		offset += len(p)
+		if i == len(payload)-1 {
+			binary.Write(&b, binary.LittleEndian, c.flags&ntlmNegotiateFlags|ntlmNegotiateUnicode)
+		}
+	}
+	b.Write(make([]byte, headerLen-b.Len()))
+	for _, p := range payload {
+		b.Write(p)
+	}
+	msg := b.Bytes()
+	if mic {
+		// Without key exchange the exported session key is the session base
+		// key, see [MS-NLMP] section 3.4.5.1.
+		sessionKey := hmacMD5(key, nt[:16])
+		copy(msg[micOffset:], hmacMD5(sessionKey, negotiate, c.raw, msg))
+	}
+	return msg, nil
+}
+
+// ntlmTargetInfo returns the challenge's target info to answer with, and the
+// server's timestamp if it has one. With a timestamp, the MsvAvFlags AV pair
+// is set to say the response has a MIC.
+func ntlmTargetInfo(info []byte) ([]byte, *uint64, error) {
+	if len(info) == 0 {
+		return nil, nil, nil
+	}
+	var (
+		out       bytes.Buffer
+		timestamp *uint64
+		flags     *uint32
+	)
+	for {
+		if len(info) < 4 {
+			return nil, nil, errors.New("ldap: malformed NTLM target info")
+		}
+		id := binary.LittleEndian.Uint16(info)
+		n := int(binary.LittleEndian.Uint16(info[2:]))
+		if n > len(info)-4 {
+			return nil, nil, errors.New("ldap: malformed NTLM target info")
+		}
+		value := info[4 : 4+n]
+		switch id {
+		case msvAvEOL:
+			if timestamp != nil {
+				f := uint32(msvAvFlagMIC)
+				if flags != nil {
+					f |= *flags
+				}
+				flags = &f
+			}
+			if flags != nil {
+				var pair [8]byte
+				binary.LittleEndian.PutUint16(pair[0:], msvAvFlags)
+				binary.LittleEndian.PutUint16(pair[2:], 4)
+				binary.LittleEndian.PutUint32(pair[4:], *flags)
+				out.Write(pair[:])
+			}
+			out.Write(info[:4])
+			return out.Bytes(), timestamp, nil
+		case msvAvFlags:
+			if n != 4 {
+				return nil, nil, errors.New("ldap: malformed NTLM target info flags")
+			}
+			// Written again before the end, with the MIC flag if needed.
+			f := binary.LittleEndian.Uint32(value)
+			flags = &f
+		case msvAvTimestamp:
+			if n != 8 {
+				return nil, nil, errors.New("ldap: malformed NTLM target info timestamp")
+			}
+			t := binary.LittleEndian.Uint64(value)
+			timestamp = &t
+			out.Write(info[:4+n])
+		default:
+			out.Write(info[:4+n])
+		}
+		info = info[4+n:]
+	}
+}
+
+// ntowfv2 derives the NTLMv2 key from the password, see [MS-NLMP] section
+// 3.3.2.
+func ntowfv2(domain, username, password string) []byte {
+	h := md4.New()
+	h.Write(utf16le(password))
+	return hmacMD5(h.Sum(nil), utf16le(strings.ToUpper(username)+domain))
+}
+
+// ntlmv2Response computes the NTLMv2 and LMv2 responses to a challenge.
+func ntlmv2Response(key, serverChallenge, clientChallenge, targetInfo []byte, timestamp uint64) (nt, lm []byte) {
+	var temp bytes.Buffer
+	temp.Write([]byte{1, 1, 0, 0, 0, 0, 0, 0})
+	binary.Write(&temp, binary.LittleEndian, timestamp)
+	temp.Write(clientChallenge)
+	temp.Write([]byte{0, 0, 0, 0})
+	temp.Write(targetInfo)
+	temp.Write([]byte{0, 0, 0, 0})
+
+	proof := hmacMD5(key, serverChallenge, temp.Bytes())
+	nt = append(proof, temp.Bytes()...)
+	lm = append(hmacMD5(key, serverChallenge, clientChallenge), clientChallenge...)
+	return nt, lm
+}
+
+func hmacMD5(key []byte, data ...[]byte) []byte {
+	h := hmac.New(md5.New, key)
+	for _, d := range data {
+		h.Write(d)
+	}
+	return h.Sum(nil)
+}
+
+func utf16le(s string) []byte {
+	u := utf16.Encode([]rune(s))
+	b := make([]byte, 2*len(u))
+	for i, r := range u {
+		binary.LittleEndian.PutUint16(b[2*i:], r)
+	}
+	return b
+}
+
+// ntlmTimestamp returns t as a Windows FILETIME, the number of 100 nanosecond
+// intervals since January 1, 1601.
+func ntlmTimestamp(t time.Time) uint64 {
+	return uint64(t.UnixNano()/100) + 116444736000000000
+}
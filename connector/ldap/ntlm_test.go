@@ -0,0 +1,154 @@
+package ldap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+)
+
+// Test vectors from [MS-NLMP] section 4.2.4.
+func TestNTLMv2Response(t *testing.T) {
+	serverChallenge, _ := hex.DecodeString("0123456789abcdef")
+	clientChallenge, _ := hex.DecodeString("aaaaaaaaaaaaaaaa")
+	targetInfo, _ := hex.DecodeString("02000c0044006f006d00610069006e0001000c0053006500720076006500720000000000")
+
+	key := ntowfv2("Domain", "User", "Password")
+	if got, want := hex.EncodeToString(key), "0c868a403bfd7a93a3001ef22ef02e3f"; got != want {
+		t.Errorf("NTOWFv2: want=%s, got=%s", want, got)
+	}
+
+	nt, lm := ntlmv2Response(key, serverChallenge, clientChallenge, targetInfo, 0)
+	if got, want := hex.EncodeToString(lm), "86c35097ac9cec102554764a57cccc19aaaaaaaaaaaaaaaa"; got != want {
+		t.Errorf("LMv2 response: want=%s, got=%s", want, got)
+	}
+	if got, want := hex.EncodeToString(nt[:16]), "68cd0ab851e51c96aabc927bebef6a1c"; got != want {
+		t.Errorf("NTProofStr: want=%s, got=%s", want, got)
+	}
+}
+
+func TestNTLMAuthenticateMessage(t *testing.T) {
+	targetInfo := []byte{0, 0, 0, 0}
+	var msg bytes.Buffer
+	msg.Write(ntlmSignature)
+	binary.Write(&msg, binary.LittleEndian, uint32(2))
+	msg.Write(make([]byte, 8)) // Target name.
+	binary.Write(&msg, binary.LittleEndian, ntlmNegotiateFlags)
+	msg.Write([]byte{1, 2, 3, 4, 5, 6, 7, 8})
+	msg.Write(make([]byte, 8))
+	binary.Write(&msg, binary.LittleEndian, uint16(len(targetInfo)))
+	binary.Write(&msg, binary.LittleEndian, uint16(len(targetInfo)))
+	binary.Write(&msg, binary.LittleEndian, uint32(48))
+	msg.Write(targetInfo)
+
+	challenge, err := parseNTLMChallenge(msg.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(challenge.serverChallenge, []byte{1, 2, 3, 4, 5, 6, 7, 8}) {
+		t.Errorf("unexpected server challenge %x", challenge.serverChallenge)
+	}
+	if !bytes.Equal(challenge.targetInfo, targetInfo) {
+		t.Errorf("unexpected target info %x", challenge.targetInfo)
+	}
+
+	auth, err := ntlmAuthenticateMessage(ntlmNegotiateMessage(), challenge, "CORP", "jane", "secret", make([]byte, 8), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The user name field is the fourth in the header.
+	n := binary.LittleEndian.Uint16(auth[36:])
+	offset := binary.LittleEndian.Uint32(auth[40:])
+	if got := auth[offset : offset+uint32(n)]; !bytes.Equal(got, utf16le("jane")) {
+		t.Errorf("unexpected user name %x", got)
+	}
+	if flags := binary.LittleEndian.Uint32(auth[60:]); flags != ntlmNegotiateFlags {
+		t.Errorf("want flags=%#x, got=%#x", ntlmNegotiateFlags, flags)
+	}
+
+	if _, err := parseNTLMChallenge(msg.Bytes()[:40]); err == nil {
+		t.Errorf("expected error for truncated challenge")
+	}
+}
+
+func TestNTLMMIC(t *testing.T) {
+	const serverTime = 0x01d0a6b5c3f0e000
+	var targetInfo bytes.Buffer
+	binary.Write(&targetInfo, binary.LittleEndian, []uint16{msvAvTimestamp, 8})
+	binary.Write(&targetInfo, binary.LittleEndian, uint64(serverTime))
+	binary.Write(&targetInfo, binary.LittleEndian, []uint16{msvAvEOL, 0})
+
+	negotiate := ntlmNegotiateMessage()
+	challenge := &ntlmChallenge{
+		flags:           ntlmNegotiateFlags,
+		serverChallenge: []byte{1, 2, 3, 4, 5, 6, 7, 8},
+		targetInfo:      targetInfo.Bytes(),
+		raw:             []byte("challenge message"),
+	}
+	auth, err := ntlmAuthenticateMessage(negotiate, challenge, "CORP", "jane", "secret", make([]byte, 8), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	field := func(i int) []byte {
+		n := binary.LittleEndian.Uint16(auth[12+8*i:])
+		offset := binary.LittleEndian.Uint32(auth[16+8*i:])
+		return auth[offset : offset+uint32(n)]
+	}
+
+	if lm := field(0); !bytes.Equal(lm, make([]byte, 24)) {
+		t.Errorf("expected an empty LMv2 response, got %x", lm)
+	}
+	nt := field(1)
+	if got := binary.LittleEndian.Uint64(nt[24:]); got != serverTime {
+		t.Errorf("expected the server's timestamp %#x, got %#x", uint64(serverTime), got)
+	}
+	// The target info in the response says there's a MIC.
+	info := nt[16+28 : len(nt)-4]
+	flags := []byte{msvAvFlags, 0, 4, 0, msvAvFlagMIC, 0, 0, 0}
+	if !bytes.Contains(info, flags) {
+		t.Errorf("expected MsvAvFlags with the MIC flag in %x", info)
+	}
+
+	key := ntowfv2("CORP", "jane", "secret")
+	zeroed := append([]byte(nil), auth...)
+	copy(zeroed[72:88], make([]byte, 16))
+	want := hmacMD5(hmacMD5(key, nt[:16]), negotiate, challenge.raw, zeroed)
+	if got := auth[72:88]; !bytes.Equal(got, want) {
+		t.Errorf("want MIC %x, got %x", want, got)
+	}
+
+	challenge.targetInfo = []byte{msvAvTimestamp, 0, 8, 0, 1}
+	if _, err := ntlmAuthenticateMessage(negotiate, challenge, "CORP", "jane", "secret", make([]byte, 8), 1); err == nil {
+		t.Errorf("expected error for truncated target info")
+	}
+}
+
+func TestNTLMConfig(t *testing.T) {
+	c := testConfig()
+	c.AnonymousBind = false
+	c.BindDN = "svc-dex"
+	c.BindMode = "ntlm"
+	if _, err := c.OpenConnector(); err == nil {
+		t.Errorf("expected error without ntlmDomain")
+	}
+	c.NTLMDomain = "CORP"
+	conn, err := c.OpenConnector()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// Users are bound as the account of the entry found.
+	attrs := conn.(*ldapConnector).userAttributes()
+	found := false
+	for _, attr := range attrs {
+		found = found || attr == "sAMAccountName"
+	}
+	if !found {
+		t.Errorf("expected the user search to read sAMAccountName, got %q", attrs)
+	}
+
+	c = testConfig()
+	c.NTLMDomain = "CORP"
+	if _, err := c.OpenConnector(); err == nil {
+		t.Errorf("expected error for ntlmDomain without bindMode ntlm")
+	}
+}
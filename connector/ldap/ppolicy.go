@@ -0,0 +1,83 @@
+package ldap
+
+import (
+	"fmt"
+	"net"
+
+	"gopkg.in/asn1-ber.v1"
+	"gopkg.in/ldap.v2"
+)
+
+// The ldap library can request the password policy control, but panics
+// decoding a response that reports an error such as changeAfterReset. Binds
+// that need the control are written directly to the network connection
+// before it's handed off to the library, like SASL binds.
+
+// changeAfterReset is the password policy error telling the user to change a
+// password set by an administrator, see draft-behera-ldap-password-policy
+// section 6.2.
+const changeAfterReset = 2
+
+// PasswordMustChangeError is returned by Login when passwordMustChange is
+// "block" and the directory says the user must change their password before
+// using the account.
+type PasswordMustChangeError struct {
+	DN string
+}
+
+func (e *PasswordMustChangeError) Error() string {
+	return fmt.Sprintf("ldap: password of %q must be changed before logging in", e.DN)
+}
+
+// policyBind performs a simple bind requesting the password policy control,
+// and reports whether the response says the password must be changed.
+func policyBind(conn net.Conn, dn, password string) (mustChange bool, err error) {
+	resp, err := rawSimpleBind(conn, dn, password, ldap.NewControlBeheraPasswordPolicy())
+	if err != nil {
+		return false, err
+	}
+	if len(resp.Children) < 3 {
+		return false, nil
+	}
+	for _, control := range resp.Children[2].Children {
+		if len(control.Children) == 0 {
+			continue
+		}
+		switch oid, _ := control.Children[0].Value.(string); oid {
+		case ldap.ControlTypeVChuPasswordMustChange:
+			// The Netscape password expired control is only returned when the
+			// password must be changed.
+			return true, nil
+		case ldap.ControlTypeBeheraPasswordPolicy:
+			if policyError(control) == changeAfterReset {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// policyError returns the error field of a password policy response control,
+// or -1 if it's missing or malformed.
+func policyError(control *ber.Packet) int64 {
+	// The value is the last child, following the optional criticality.
+	value := control.Children[len(control.Children)-1]
+	if len(control.Children) < 2 || value.Tag != ber.TagOctetString {
+		return -1
+	}
+	policy, err := ber.DecodePacketErr(value.Data.Bytes())
+	if err != nil {
+		return -1
+	}
+	for _, child := range policy.Children {
+		if child.ClassType != ber.ClassContext || child.Tag != 1 {
+			continue
+		}
+		b := child.Data.Bytes()
+		if len(b) != 1 {
+			return -1
+		}
+		return int64(b[0])
+	}
+	return -1
+}
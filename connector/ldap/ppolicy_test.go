@@ -0,0 +1,177 @@
+package ldap
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"golang.org/x/net/context"
+	"gopkg.in/asn1-ber.v1"
+	"gopkg.in/ldap.v2"
+
+	"github.com/coreos/dex/connector"
+)
+
+// fakeResponseControl encodes a response control with a raw value.
+func fakeResponseControl(oid string, value *ber.Packet) *ber.Packet {
+	control := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Control")
+	control.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, oid, "Control Type"))
+	if value != nil {
+		control.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, string(value.Bytes()), "Control Value"))
+	}
+	return control
+}
+
+// fakePolicyControl returns a password policy response control with the
+// error field set, or only a grace logins warning if policyErr is negative.
+func fakePolicyControl(policyErr int64) *ber.Packet {
+	value := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Password Policy")
+	if policyErr < 0 {
+		warning := ber.Encode(ber.ClassContext, ber.TypeConstructed, 0, nil, "Warning")
+		warning.AppendChild(ber.NewInteger(ber.ClassContext, ber.TypePrimitive, 1, 3, "Grace Logins Remaining"))
+		value.AppendChild(warning)
+	} else {
+		value.AppendChild(ber.NewInteger(ber.ClassContext, ber.TypePrimitive, 1, policyErr, "Error"))
+	}
+	return fakeResponseControl(ldap.ControlTypeBeheraPasswordPolicy, value)
+}
+
+// answerPolicyBind reads a bind request from conn and answers it with the
+// result code and, if the password policy control was requested, controls.
+// It reports whether the control was requested.
+func answerPolicyBind(conn net.Conn, code uint8, controls ...*ber.Packet) (requested bool, err error) {
+	packet, err := ber.ReadPacket(conn)
+	if err != nil {
+		return false, err
+	}
+	if len(packet.Children) == 3 {
+		for _, control := range packet.Children[2].Children {
+			if control.Children[0].Value == ldap.ControlTypeBeheraPasswordPolicy {
+				requested = true
+			}
+		}
+	}
+	resp := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	resp.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, packet.Children[0].Value, "MessageID"))
+	resp.AppendChild(fakeResult(ldap.ApplicationBindResponse, code))
+	if requested && len(controls) != 0 {
+		encoded := ber.Encode(ber.ClassContext, ber.TypeConstructed, 0, nil, "Controls")
+		for _, control := range controls {
+			encoded.AppendChild(control)
+		}
+		resp.AppendChild(encoded)
+	}
+	_, err = conn.Write(resp.Bytes())
+	return requested, err
+}
+
+func TestPolicyBind(t *testing.T) {
+	tests := []struct {
+		name     string
+		code     uint8
+		controls []*ber.Packet
+
+		wantMustChange bool
+		wantErr        bool
+	}{
+		{name: "no control"},
+		{name: "change after reset", controls: []*ber.Packet{fakePolicyControl(changeAfterReset)}, wantMustChange: true},
+		{name: "password expired", controls: []*ber.Packet{fakePolicyControl(0)}},
+		{name: "warning", controls: []*ber.Packet{fakePolicyControl(-1)}},
+		{name: "empty policy", controls: []*ber.Packet{fakeResponseControl(ldap.ControlTypeBeheraPasswordPolicy, nil)}},
+		{
+			name:           "netscape password expired",
+			controls:       []*ber.Packet{fakeResponseControl(ldap.ControlTypeVChuPasswordMustChange, ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "0", ""))},
+			wantMustChange: true,
+		},
+		{name: "invalid credentials", code: ldap.LDAPResultInvalidCredentials, wantErr: true},
+	}
+	for _, tc := range tests {
+		client, server := net.Pipe()
+		go func() {
+			defer server.Close()
+			if requested, err := answerPolicyBind(server, tc.code, tc.controls...); err == nil && !requested {
+				t.Errorf("%s: password policy control not requested", tc.name)
+			}
+		}()
+
+		mustChange, err := policyBind(client, "uid=jane,ou=people,dc=example,dc=com", "password")
+		client.Close()
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s: wantErr=%t, got err=%v", tc.name, tc.wantErr, err)
+		}
+		if mustChange != tc.wantMustChange {
+			t.Errorf("%s: want mustChange=%t, got %t", tc.name, tc.wantMustChange, mustChange)
+		}
+	}
+}
+
+func TestPasswordMustChange(t *testing.T) {
+	const userDN = "uid=jane,ou=people,dc=example,dc=com"
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			// Every connection starts with a bind, either anonymous as the
+			// service account or as the user, who must change their password.
+			go func() {
+				if _, err := answerPolicyBind(conn, ldap.LDAPResultSuccess, fakePolicyControl(changeAfterReset)); err != nil {
+					conn.Close()
+					return
+				}
+				serveFake(conn, func(boundDN string, req *ber.Packet, controls []ldap.Control) []fakeResponse {
+					return []fakeResponse{
+						{op: fakeEntry(userDN, map[string][]string{"uid": {"jane"}, "mail": {"jane@example.com"}})},
+						{op: fakeResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)},
+					}
+				})
+			}()
+		}
+	}()
+
+	for _, bindDNTemplate := range []string{"", "uid={{.Username}},ou=people,dc=example,dc=com"} {
+		for _, mode := range []string{passwordMustChangeAllow, passwordMustChangeBlock} {
+			c := testConfig()
+			c.Host = l.Addr().String()
+			c.InsecureNoSSL = true
+			c.PasswordMustChange = mode
+			c.UserSearch.IDAttr = "uid"
+			c.UserSearch.EmailAttr = "mail"
+			if bindDNTemplate != "" {
+				c.UserSearch.BaseDN = ""
+				c.UserSearch.BindDNTemplate = bindDNTemplate
+			}
+			conn, err := c.OpenConnector()
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, valid, err := conn.Login(context.Background(), connector.Scopes{}, "jane", "password")
+			conn.Close()
+
+			if mode == passwordMustChangeAllow {
+				if err != nil || !valid {
+					t.Errorf("%s %q: expected login to succeed, got valid=%t err=%v", mode, bindDNTemplate, valid, err)
+				}
+				continue
+			}
+			var mustChange *PasswordMustChangeError
+			if !errors.As(err, &mustChange) || mustChange.DN != userDN {
+				t.Errorf("%s %q: expected *PasswordMustChangeError for %q, got valid=%t err=%v", mode, bindDNTemplate, userDN, valid, err)
+			}
+		}
+	}
+
+	c := testConfig()
+	c.PasswordMustChange = "warn"
+	if _, err := c.OpenConnector(); err == nil {
+		t.Errorf("expected error for unknown passwordMustChange value")
+	}
+}
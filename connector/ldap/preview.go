@@ -0,0 +1,139 @@
+package ldap
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/context"
+	"gopkg.in/ldap.v2"
+)
+
+// redactedValue replaces the values of redacted attributes in an
+// EntryPreview.
+const redactedValue = "REDACTED"
+
+// alwaysRedacted holds the attributes, lowercased, whose values PreviewEntry
+// and userSearch.logEntry never return, as they hold credentials or their
+// hashes.
+var alwaysRedacted = map[string]bool{
+	"userpassword": true,
+	"authpassword": true,
+	"userpkcs12":   true,
+	// Password policy (draft-behera-ldap-password-policy).
+	"pwdhistory": true,
+	// Active Directory, including LAPS and managed service accounts.
+	"unicodepwd":                          true,
+	"dbcspwd":                             true,
+	"ntpwdhistory":                        true,
+	"lmpwdhistory":                        true,
+	"supplementalcredentials":             true,
+	"ms-mcs-admpwd":                       true,
+	"mslaps-password":                     true,
+	"mslaps-encryptedpassword":            true,
+	"mslaps-encryptedpasswordhistory":     true,
+	"mslaps-encrypteddsrmpassword":        true,
+	"mslaps-encrypteddsrmpasswordhistory": true,
+	"msds-managedpassword":                true,
+	"trustauthincoming":                   true,
+	"trustauthoutgoing":                   true,
+	// Samba and Kerberos.
+	"sambantpassword":      true,
+	"sambalmpassword":      true,
+	"sambapasswordhistory": true,
+	"krbprincipalkey":      true,
+}
+
+// EntryPreview is an entry as read by PreviewEntry.
+type EntryPreview struct {
+	DN string
+	// The attributes the service account can read, including operational
+	// ones. Values of redacted attributes are replaced with "REDACTED".
+	Attributes map[string][]string
+	// The names of the redacted attributes, sorted.
+	Redacted []string
+}
+
+// PreviewEntry reads every attribute of the entry named by dn that the
+// service account can read, for support teams diagnosing why a user's claims
+// are wrong without access to the directory. Credentials and the attributes
+// in previewRedactAttributes are redacted. found is false if the entry
+// doesn't exist or can't be read.
+//
+// PreviewEntry fails unless allowEntryPreview is set.
+func (c *Config) PreviewEntry(ctx context.Context, dn string) (preview EntryPreview, found bool, err error) {
+	conn, err := c.OpenConnector()
+	if err != nil {
+		return EntryPreview{}, false, err
+	}
+	defer conn.Close()
+	return conn.(*ldapConnector).previewEntry(ctx, dn)
+}
+
+func (c *ldapConnector) previewEntry(ctx context.Context, dn string) (preview EntryPreview, found bool, err error) {
+	if !c.AllowEntryPreview {
+		return EntryPreview{}, false, errors.New("ldap: previewing entries requires allowEntryPreview to be set")
+	}
+	if _, err := ldap.ParseDN(dn); err != nil || dn == "" {
+		return EntryPreview{}, false, fmt.Errorf("ldap: invalid DN %q", dn)
+	}
+	c.logf(ctx, "ldap: previewing entry %q", dn)
+
+	req := &ldap.SearchRequest{
+		BaseDN: dn,
+		Filter: "(objectClass=*)",
+		Scope:  ldap.ScopeBaseObject,
+		// All user and operational attributes, see RFC 3673.
+		Attributes: []string{"*", "+"},
+	}
+	var entry *ldap.Entry
+	err = c.doRead(ctx, func(conn *ldap.Conn) error {
+		resp, err := c.search(ctx, conn, req)
+		if err != nil {
+			if isResultCode(err, ldap.LDAPResultNoSuchObject) {
+				return nil
+			}
+			return err
+		}
+		if len(resp.Entries) == 1 {
+			entry = resp.Entries[0]
+		}
+		return nil
+	})
+	if err != nil || entry == nil {
+		return EntryPreview{}, false, err
+	}
+
+	preview = EntryPreview{DN: entry.DN, Attributes: entryAttributes(*entry)}
+	for name, values := range preview.Attributes {
+		if !c.redacted(name) {
+			continue
+		}
+		redacted := make([]string, len(values))
+		for i := range redacted {
+			redacted[i] = redactedValue
+		}
+		preview.Attributes[name] = redacted
+		preview.Redacted = append(preview.Redacted, name)
+	}
+	sort.Strings(preview.Redacted)
+	return preview, true, nil
+}
+
+// redacted reports if PreviewEntry and userSearch.logEntry redact the values
+// of the named attribute. Attribute options, such as ";binary", are ignored.
+func (c *ldapConnector) redacted(name string) bool {
+	if i := strings.Index(name, ";"); i >= 0 {
+		name = name[:i]
+	}
+	if alwaysRedacted[strings.ToLower(name)] {
+		return true
+	}
+	for _, attr := range c.PreviewRedactAttributes {
+		if strings.EqualFold(attr, name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,79 @@
+package ldap
+
+import (
+	"reflect"
+	"testing"
+
+	"golang.org/x/net/context"
+	"gopkg.in/asn1-ber.v1"
+	"gopkg.in/ldap.v2"
+)
+
+func TestPreviewEntry(t *testing.T) {
+	const dn = "uid=jane,ou=people,dc=example,dc=com"
+	addr, stop := fakeServer(t, func(req *ber.Packet, controls []ldap.Control) []fakeResponse {
+		var attrs []string
+		for _, attr := range req.Children[7].Children {
+			attrs = append(attrs, attr.Value.(string))
+		}
+		if want := []string{"*", "+"}; !reflect.DeepEqual(attrs, want) {
+			t.Errorf("want attributes %q requested, got %q", want, attrs)
+		}
+		if req.Children[0].Value.(string) != dn {
+			return []fakeResponse{{op: fakeResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultNoSuchObject)}}
+		}
+		return []fakeResponse{
+			{op: fakeEntry(dn, map[string][]string{
+				"uid":                  {"jane"},
+				"mail":                 {"jane@example.com"},
+				"homePhone":            {"555-0100"},
+				"userPassword":         {"{SSHA}secret"},
+				"memberOf":             {"cn=admins,ou=groups,dc=example,dc=com"},
+				"MS-Mcs-AdmPwd;binary": {"laps-secret"},
+			})},
+			{op: fakeResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)},
+		}
+	})
+	defer stop()
+
+	c := testConfig()
+	c.Host = addr
+	c.InsecureNoSSL = true
+	if _, _, err := c.PreviewEntry(context.Background(), dn); err == nil {
+		t.Errorf("expected preview to require allowEntryPreview")
+	}
+
+	c.AllowEntryPreview = true
+	c.PreviewRedactAttributes = []string{"homephone"}
+	conn, err := c.OpenConnector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lc := conn.(*ldapConnector)
+	preview, found, err := lc.previewEntry(context.Background(), dn)
+	if err != nil || !found {
+		t.Fatalf("expected entry, got found=%t err=%v", found, err)
+	}
+	want := EntryPreview{
+		DN: dn,
+		Attributes: map[string][]string{
+			"uid":                  {"jane"},
+			"mail":                 {"jane@example.com"},
+			"homePhone":            {"REDACTED"},
+			"userPassword":         {"REDACTED"},
+			"memberOf":             {"cn=admins,ou=groups,dc=example,dc=com"},
+			"MS-Mcs-AdmPwd;binary": {"REDACTED"},
+		},
+		Redacted: []string{"MS-Mcs-AdmPwd;binary", "homePhone", "userPassword"},
+	}
+	if !reflect.DeepEqual(preview, want) {
+		t.Errorf("want preview %+v, got %+v", want, preview)
+	}
+
+	if _, found, err := lc.previewEntry(context.Background(), "uid=john,ou=people,dc=example,dc=com"); err != nil || found {
+		t.Errorf("expected missing entry not to be found, got found=%t err=%v", found, err)
+	}
+	if _, _, err := lc.previewEntry(context.Background(), "not a dn"); err == nil {
+		t.Errorf("expected invalid DN to be rejected")
+	}
+}
@@ -0,0 +1,94 @@
+package ldap
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/context"
+	"gopkg.in/ldap.v2"
+)
+
+// Active Directory returns at most MaxValRange values, 1500 by default, of a
+// large attribute such as member or memberOf. The values are returned under a
+// name with a range option, such as "member;range=0-1499", and the rest must
+// be read with base searches of the entry requesting "member;range=1500-*"
+// until a range ending in "*" is returned, see [MS-ADTS] section
+// 3.1.1.3.1.3.3.
+
+// maxRangeRequests bounds the number of searches made to read the values of
+// a ranged attribute, in case a server never returns the last range.
+const maxRangeRequests = 1000
+
+// rangedValues returns the values of the named attribute of the entry,
+// reading the remaining ranges from the server if the entry only holds the
+// first one.
+func (c *ldapConnector) rangedValues(ctx context.Context, e ldap.Entry, name string) ([]string, error) {
+	values, high, ok, err := findRange(e, name)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return attrValues(e, name), nil
+	}
+
+	// Copy so that appending doesn't modify the entry.
+	values = append([]string(nil), values...)
+	err = c.doRead(ctx, func(conn *ldap.Conn) error {
+		for i := 0; high != "*"; i++ {
+			if i == maxRangeRequests {
+				return fmt.Errorf("ldap: entry %q: too many ranges for attribute %q", e.DN, name)
+			}
+			n, err := strconv.Atoi(high)
+			if err != nil {
+				return fmt.Errorf("ldap: entry %q: invalid range end %q for attribute %q", e.DN, high, name)
+			}
+			req := &ldap.SearchRequest{
+				BaseDN:     e.DN,
+				Scope:      ldap.ScopeBaseObject,
+				Filter:     "(objectClass=*)",
+				Attributes: []string{fmt.Sprintf("%s;range=%d-*", name, n+1)},
+			}
+			resp, err := c.search(ctx, conn, req)
+			if err != nil {
+				return err
+			}
+			if len(resp.Entries) != 1 {
+				return fmt.Errorf("ldap: entry %q: expected one entry reading attribute %q, got %d", e.DN, name, len(resp.Entries))
+			}
+			var next []string
+			next, high, ok, err = findRange(*resp.Entries[0], name)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return fmt.Errorf("ldap: entry %q: server didn't return a range of attribute %q", e.DN, name)
+			}
+			values = append(values, next...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// findRange returns the values of the named attribute with a range option in
+// the entry, and the end of the range, which is "*" for the last one. ok is
+// false if the entry has no ranged values of the attribute.
+func findRange(e ldap.Entry, name string) (values []string, high string, ok bool, err error) {
+	prefix := strings.ToLower(name) + ";range="
+	for _, a := range e.Attributes {
+		if !strings.HasPrefix(strings.ToLower(a.Name), prefix) {
+			continue
+		}
+		r := a.Name[len(prefix):]
+		i := strings.Index(r, "-")
+		if i < 0 {
+			return nil, "", false, fmt.Errorf("ldap: entry %q: invalid range %q for attribute %q", e.DN, r, name)
+		}
+		return a.Values, r[i+1:], true, nil
+	}
+	return nil, "", false, nil
+}
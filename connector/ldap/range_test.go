@@ -0,0 +1,93 @@
+package ldap
+
+import (
+	"reflect"
+	"testing"
+
+	"golang.org/x/net/context"
+	"gopkg.in/asn1-ber.v1"
+	"gopkg.in/ldap.v2"
+
+	"github.com/coreos/dex/connector"
+)
+
+func TestRangedUserGroupsAttr(t *testing.T) {
+	const userDN = "cn=jane,ou=people,dc=example,dc=com"
+	// The values returned for each requested range, as Active Directory would
+	// with a MaxValRange of 2.
+	ranges := map[string]fakeResponse{
+		"memberOf;range=2-*": {op: fakeEntry(userDN, map[string][]string{"memberOf;range=2-3": {"c", "d"}})},
+		"memberOf;range=4-*": {op: fakeEntry(userDN, map[string][]string{"memberOf;range=4-*": {"e"}})},
+	}
+	var requested []string
+	addr, stop := fakeServer(t, func(req *ber.Packet, controls []ldap.Control) []fakeResponse {
+		done := fakeResponse{op: fakeResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)}
+		if req.Children[0].Value.(string) == userDN {
+			attr := req.Children[7].Children[0].Value.(string)
+			requested = append(requested, attr)
+			entry, ok := ranges[attr]
+			if !ok {
+				t.Errorf("unexpected range request %q", attr)
+				return []fakeResponse{done}
+			}
+			return []fakeResponse{entry, done}
+		}
+		return []fakeResponse{
+			{op: fakeEntry(userDN, map[string][]string{
+				"uid":                {"jane"},
+				"mail":               {"jane@example.com"},
+				"memberOf;range=0-1": {"a", "b"},
+			})},
+			done,
+		}
+	})
+	defer stop()
+
+	c := testConfig()
+	c.Host = addr
+	c.InsecureNoSSL = true
+	c.UserSearch.IDAttr = "uid"
+	c.UserSearch.EmailAttr = "mail"
+	c.GroupSearch.UserGroupsAttr = "memberOf"
+	conn, err := c.OpenConnector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ident, valid, err := conn.Login(context.Background(), connector.Scopes{Groups: true}, "jane", "secret")
+	if err != nil || !valid {
+		t.Fatalf("expected valid login, got valid=%t err=%v", valid, err)
+	}
+	if want := []string{"a", "b", "c", "d", "e"}; !reflect.DeepEqual(ident.Groups, want) {
+		t.Errorf("want groups %q, got %q", want, ident.Groups)
+	}
+	if want := []string{"memberOf;range=2-*", "memberOf;range=4-*"}; !reflect.DeepEqual(requested, want) {
+		t.Errorf("want ranges requested %q, got %q", want, requested)
+	}
+}
+
+func TestFindRange(t *testing.T) {
+	tests := []struct {
+		name    string
+		attrs   map[string][]string
+		values  []string
+		high    string
+		ok      bool
+		wantErr bool
+	}{
+		{name: "not ranged", attrs: map[string][]string{"member": {"a"}}},
+		{name: "first", attrs: map[string][]string{"member;range=0-1499": {"a"}}, values: []string{"a"}, high: "1499", ok: true},
+		{name: "last", attrs: map[string][]string{"Member;Range=1500-*": {"b"}}, values: []string{"b"}, high: "*", ok: true},
+		{name: "invalid", attrs: map[string][]string{"member;range=1500": {"b"}}, wantErr: true},
+	}
+	for _, test := range tests {
+		e := ldap.NewEntry("cn=admins,dc=example,dc=com", test.attrs)
+		values, high, ok, err := findRange(*e, "member")
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: want error %t, got %v", test.name, test.wantErr, err)
+			continue
+		}
+		if !reflect.DeepEqual(values, test.values) || high != test.high || ok != test.ok {
+			t.Errorf("%s: want (%q, %q, %t), got (%q, %q, %t)", test.name, test.values, test.high, test.ok, values, high, ok)
+		}
+	}
+}
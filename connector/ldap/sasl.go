@@ -0,0 +1,106 @@
+package ldap
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"gopkg.in/asn1-ber.v1"
+	"gopkg.in/ldap.v2"
+)
+
+// The ldap library doesn't support SASL binds, so SASL EXTERNAL is
+// implemented by writing the bind request directly to the network connection
+// before it's handed off to the library.
+
+// rawMessageID is the message ID used for requests sent before the connection
+// is wrapped by an ldap.Conn. The library doesn't begin issuing IDs until it
+// sends its own first request, so reusing an ID here is safe once the
+// response has been read.
+const rawMessageID = 1
+
+// rawRequest writes a single LDAP request to conn and reads the response.
+func rawRequest(conn net.Conn, op *ber.Packet, controls ...ldap.Control) (*ber.Packet, error) {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Request")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, rawMessageID, "MessageID"))
+	packet.AppendChild(op)
+	if len(controls) != 0 {
+		encoded := ber.Encode(ber.ClassContext, ber.TypeConstructed, 0, nil, "Controls")
+		for _, control := range controls {
+			encoded.AppendChild(control.Encode())
+		}
+		packet.AppendChild(encoded)
+	}
+
+	if _, err := conn.Write(packet.Bytes()); err != nil {
+		return nil, ldap.NewError(ldap.ErrorNetwork, err)
+	}
+	resp, err := ber.ReadPacket(conn)
+	if err != nil {
+		return nil, ldap.NewError(ldap.ErrorNetwork, err)
+	}
+	if len(resp.Children) < 2 {
+		return nil, ldap.NewError(ldap.ErrorUnexpectedResponse, errors.New("ldap: malformed response"))
+	}
+	return resp, nil
+}
+
+// rawResultCode returns the result code of a response read by rawRequest as
+// an *ldap.Error. It returns nil if the operation succeeded.
+func rawResultCode(resp *ber.Packet) error {
+	op := resp.Children[1]
+	if len(op.Children) < 3 {
+		return ldap.NewError(ldap.ErrorUnexpectedResponse, errors.New("ldap: malformed response"))
+	}
+	code, ok := op.Children[0].Value.(int64)
+	if !ok {
+		return ldap.NewError(ldap.ErrorUnexpectedResponse, errors.New("ldap: malformed result code"))
+	}
+	if code == ldap.LDAPResultSuccess {
+		return nil
+	}
+	diagnostic, _ := op.Children[2].Value.(string)
+	return ldap.NewError(uint8(code), errors.New(diagnostic))
+}
+
+// saslExternalBind performs a SASL EXTERNAL bind (RFC 4422 appendix A),
+// asking the server to authenticate the client using credentials established
+// by a lower layer, such as a TLS client certificate.
+func saslExternalBind(conn net.Conn) error {
+	req := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationBindRequest, nil, "Bind Request")
+	req.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, 3, "Version"))
+	req.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "User Name"))
+	auth := ber.Encode(ber.ClassContext, ber.TypeConstructed, 3, nil, "SASL Credentials")
+	auth.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "EXTERNAL", "Mechanism"))
+	req.AppendChild(auth)
+
+	resp, err := rawRequest(conn, req)
+	if err != nil {
+		return err
+	}
+	if tag := resp.Children[1].Tag; tag != ldap.ApplicationBindResponse {
+		return ldap.NewError(ldap.ErrorUnexpectedResponse, fmt.Errorf("ldap: expected bind response got tag %d", tag))
+	}
+	return rawResultCode(resp)
+}
+
+// rawSimpleBind performs a simple bind with the controls, returning the
+// response so callers can inspect its controls.
+func rawSimpleBind(conn net.Conn, dn, password string, controls ...ldap.Control) (*ber.Packet, error) {
+	req := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationBindRequest, nil, "Bind Request")
+	req.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, 3, "Version"))
+	req.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, dn, "User Name"))
+	req.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 0, password, "Password"))
+
+	resp, err := rawRequest(conn, req, controls...)
+	if err != nil {
+		return nil, err
+	}
+	if tag := resp.Children[1].Tag; tag != ldap.ApplicationBindResponse {
+		return nil, ldap.NewError(ldap.ErrorUnexpectedResponse, fmt.Errorf("ldap: expected bind response got tag %d", tag))
+	}
+	if err := rawResultCode(resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
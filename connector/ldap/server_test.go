@@ -0,0 +1,272 @@
+package ldap
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"gopkg.in/asn1-ber.v1"
+	"gopkg.in/ldap.v2"
+)
+
+// fakeResponse is a response sent by fakeServer.
+type fakeResponse struct {
+	op       *ber.Packet
+	controls []ldap.Control
+}
+
+// fakeServer serves LDAP requests on a local port until the returned function
+// is called. Binds always succeed, and search requests, along with their
+// controls, are passed to handle.
+func fakeServer(t testing.TB, handle func(req *ber.Packet, controls []ldap.Control) []fakeResponse) (addr string, stop func()) {
+	return fakeServerBound(t, func(boundDN string, req *ber.Packet, controls []ldap.Control) []fakeResponse {
+		return handle(req, controls)
+	})
+}
+
+// fakeServerBound is the same as fakeServer but also passes handle the DN the
+// connection was last bound as.
+func fakeServerBound(t testing.TB, handle func(boundDN string, req *ber.Packet, controls []ldap.Control) []fakeResponse) (addr string, stop func()) {
+	return fakeServerBinds(t, nil, handle)
+}
+
+func serveFake(conn net.Conn, handle func(boundDN string, req *ber.Packet, controls []ldap.Control) []fakeResponse) {
+	serveFakeBinds(conn, nil, handle)
+}
+
+// fakeServerBinds is the same as fakeServerBound but answers simple binds
+// with the result returned by bind.
+func fakeServerBinds(t testing.TB, bind func(dn, password string) *ber.Packet, handle func(boundDN string, req *ber.Packet, controls []ldap.Control) []fakeResponse) (addr string, stop func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveFakeBinds(conn, bind, handle)
+		}
+	}()
+	return l.Addr().String(), func() { l.Close() }
+}
+
+func serveFakeBinds(conn net.Conn, bind func(dn, password string) *ber.Packet, handle func(boundDN string, req *ber.Packet, controls []ldap.Control) []fakeResponse) {
+	defer conn.Close()
+	var boundDN string
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		msgID := packet.Children[0]
+		req := packet.Children[1]
+
+		var responses []fakeResponse
+		switch req.Tag {
+		case ldap.ApplicationBindRequest:
+			if len(req.Children) > 1 {
+				boundDN, _ = req.Children[1].Value.(string)
+			}
+			responses = []fakeResponse{{op: fakeResult(ldap.ApplicationBindResponse, ldap.LDAPResultSuccess)}}
+			if bind != nil && len(req.Children) > 2 {
+				password := string(req.Children[2].Data.Bytes())
+				responses = []fakeResponse{{op: bind(boundDN, password)}}
+			}
+		case ldap.ApplicationSearchRequest:
+			var controls []ldap.Control
+			if len(packet.Children) == 3 {
+				for _, child := range packet.Children[2].Children {
+					controls = append(controls, ldap.DecodeControl(child))
+				}
+			}
+			responses = handle(boundDN, req, controls)
+		default:
+			// Unbind or an unsupported operation.
+			return
+		}
+
+		for _, resp := range responses {
+			envelope := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+			envelope.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, msgID.Value, "MessageID"))
+			envelope.AppendChild(resp.op)
+			if len(resp.controls) != 0 {
+				controls := ber.Encode(ber.ClassContext, ber.TypeConstructed, 0, nil, "Controls")
+				for _, control := range resp.controls {
+					controls.AppendChild(control.Encode())
+				}
+				envelope.AppendChild(controls)
+			}
+			if _, err := conn.Write(envelope.Bytes()); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// fakeReferral returns a search result reference to the LDAP URLs.
+func fakeReferral(urls ...string) *ber.Packet {
+	ref := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultReference, nil, "Search Result Reference")
+	for _, u := range urls {
+		ref.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, u, "URI"))
+	}
+	return ref
+}
+
+// fakeResult returns an operation result such as a bind response or search
+// result done.
+func fakeResult(tag ber.Tag, code uint8) *ber.Packet {
+	return fakeResultMessage(tag, code, "")
+}
+
+// fakeResultMessage is the same as fakeResult with a diagnostic message.
+func fakeResultMessage(tag ber.Tag, code uint8, msg string) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Result")
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), "Result Code"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Matched DN"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, msg, "Diagnostic Message"))
+	return op
+}
+
+// fakeEntry returns a search result entry.
+func fakeEntry(dn string, attrs map[string][]string) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "Search Result Entry")
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, dn, "Object Name"))
+	attributes := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attributes")
+	for name, values := range attrs {
+		attr := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attribute")
+		attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "Type"))
+		set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "Values")
+		for _, value := range values {
+			set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, value, "Value"))
+		}
+		attr.AppendChild(set)
+		attributes.AppendChild(attr)
+	}
+	op.AppendChild(attributes)
+	return op
+}
+
+// testCertificates returns a new root CA in PEM form and a server certificate
+// it issued for dnsName.
+func testCertificates(t *testing.T, dnsName string) (caPEM []byte, cert tls.Certificate) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: dnsName},
+		DNSNames:     []string{dnsName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER})
+	return caPEM, tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// tlsServer accepts TLS connections using cert until the returned function is
+// called, completing the handshake and then waiting for the client to close
+// the connection.
+func tlsServer(t *testing.T, cert tls.Certificate) (addr string, stop func()) {
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if err := conn.(*tls.Conn).Handshake(); err != nil {
+					return
+				}
+				io.Copy(ioutil.Discard, conn)
+			}()
+		}
+	}()
+	return l.Addr().String(), func() { l.Close() }
+}
+
+// startTLSServer is the same as fakeServer but requires clients to start TLS
+// with the StartTLS operation, using cert, before sending other requests.
+func startTLSServer(t *testing.T, cert tls.Certificate, handle func(req *ber.Packet, controls []ldap.Control) []fakeResponse) (addr string, stop func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				packet, err := ber.ReadPacket(conn)
+				if err != nil || len(packet.Children) < 2 || packet.Children[1].Tag != ldap.ApplicationExtendedRequest {
+					conn.Close()
+					return
+				}
+				resp := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+				resp.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, packet.Children[0].Value, "MessageID"))
+				resp.AppendChild(fakeResult(ldap.ApplicationExtendedResponse, ldap.LDAPResultSuccess))
+				if _, err := conn.Write(resp.Bytes()); err != nil {
+					conn.Close()
+					return
+				}
+				tlsConn := tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{cert}})
+				if err := tlsConn.Handshake(); err != nil {
+					conn.Close()
+					return
+				}
+				serveFake(tlsConn, func(boundDN string, req *ber.Packet, controls []ldap.Control) []fakeResponse {
+					return handle(req, controls)
+				})
+			}()
+		}
+	}()
+	return l.Addr().String(), func() { l.Close() }
+}
@@ -0,0 +1,80 @@
+package ldap
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Transform types.
+const (
+	transformBeforeAt  = "beforeAt"
+	transformAfterAt   = "afterAt"
+	transformLowercase = "lowercase"
+	transformUppercase = "uppercase"
+	transformReplace   = "replace"
+)
+
+// Transform modifies an attribute value before it's mapped to the identity.
+type Transform struct {
+	// Can either be:
+	// * "beforeAt" - keep the part before the last "@", e.g. strip the realm
+	//   from a userPrincipalName
+	// * "afterAt" - keep the part after the last "@"
+	// * "lowercase"
+	// * "uppercase"
+	// * "replace" - replace matches of regex with replacement
+	Type string `json:"type"`
+
+	// Used by "replace". The replacement may refer to submatches as "$1".
+	Regex       string `json:"regex"`
+	Replacement string `json:"replacement"`
+}
+
+// transformFunc is a compiled list of transforms.
+type transformFunc func(string) string
+
+// compileTransforms compiles the transforms for a field. The field is only
+// used in errors.
+func compileTransforms(field string, transforms []Transform) (transformFunc, error) {
+	var funcs []transformFunc
+	for i, t := range transforms {
+		if t.Type != transformReplace && (t.Regex != "" || t.Replacement != "") {
+			return nil, fmt.Errorf("ldap: %s[%d]: regex and replacement can only be used with type %q", field, i, transformReplace)
+		}
+		switch t.Type {
+		case transformBeforeAt:
+			funcs = append(funcs, func(s string) string {
+				if i := strings.LastIndex(s, "@"); i >= 0 {
+					return s[:i]
+				}
+				return s
+			})
+		case transformAfterAt:
+			funcs = append(funcs, func(s string) string {
+				return s[strings.LastIndex(s, "@")+1:]
+			})
+		case transformLowercase:
+			funcs = append(funcs, strings.ToLower)
+		case transformUppercase:
+			funcs = append(funcs, strings.ToUpper)
+		case transformReplace:
+			re, err := regexp.Compile(t.Regex)
+			if err != nil {
+				return nil, fmt.Errorf("ldap: %s[%d]: parse regex: %v", field, i, err)
+			}
+			replacement := t.Replacement
+			funcs = append(funcs, func(s string) string {
+				return re.ReplaceAllString(s, replacement)
+			})
+		default:
+			return nil, fmt.Errorf("ldap: %s[%d].type unknown value %q", field, i, t.Type)
+		}
+	}
+	return func(s string) string {
+		for _, f := range funcs {
+			s = f(s)
+		}
+		return s
+	}, nil
+}
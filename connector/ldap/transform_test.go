@@ -0,0 +1,76 @@
+package ldap
+
+import (
+	"testing"
+
+	"gopkg.in/ldap.v2"
+)
+
+func TestTransforms(t *testing.T) {
+	tests := []struct {
+		transforms []Transform
+		in         string
+		want       string
+	}{
+		{nil, "Alice@corp.example.com", "Alice@corp.example.com"},
+		{[]Transform{{Type: "beforeAt"}}, "alice@corp.example.com", "alice"},
+		{[]Transform{{Type: "beforeAt"}}, "alice", "alice"},
+		{[]Transform{{Type: "afterAt"}}, "alice@corp.example.com", "corp.example.com"},
+		{[]Transform{{Type: "beforeAt"}, {Type: "lowercase"}}, "Alice@CORP", "alice"},
+		{[]Transform{{Type: "uppercase"}}, "alice", "ALICE"},
+		{
+			[]Transform{{Type: "replace", Regex: `^CORP\\(.*)$`, Replacement: "$1"}},
+			`CORP\alice`, "alice",
+		},
+	}
+	for _, tc := range tests {
+		f, err := compileTransforms("idAttr", tc.transforms)
+		if err != nil {
+			t.Errorf("%v: %v", tc.transforms, err)
+			continue
+		}
+		if got := f(tc.in); got != tc.want {
+			t.Errorf("%v: %q: want=%q, got=%q", tc.transforms, tc.in, tc.want, got)
+		}
+	}
+
+	invalid := [][]Transform{
+		{{Type: "trim"}},
+		{{Type: "replace", Regex: "("}},
+		{{Type: "lowercase", Regex: "a"}},
+	}
+	for _, transforms := range invalid {
+		if _, err := compileTransforms("idAttr", transforms); err == nil {
+			t.Errorf("%v: expected error", transforms)
+		}
+	}
+}
+
+func TestIdentityTransforms(t *testing.T) {
+	c := testConfig()
+	c.UserSearch.IDAttr = "userPrincipalName"
+	c.UserSearch.EmailAttr = "mail"
+	c.UserSearch.Transforms = map[string][]Transform{
+		"idAttr": {{Type: "beforeAt"}, {Type: "lowercase"}},
+	}
+	conn, err := c.OpenConnector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := ldap.NewEntry("cn=alice,dc=example,dc=com", map[string][]string{
+		"userPrincipalName": {"Alice@corp.example.com"},
+		"mail":              {"alice@example.com"},
+	})
+	ident, err := conn.(*ldapConnector).identityFromEntry(*user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ident.UserID != "alice" {
+		t.Errorf("want=%q, got=%q", "alice", ident.UserID)
+	}
+
+	c.UserSearch.Transforms = map[string][]Transform{"groups": {{Type: "lowercase"}}}
+	if _, err := c.OpenConnector(); err == nil {
+		t.Errorf("expected error for unknown transform field")
+	}
+}
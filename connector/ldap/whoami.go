@@ -0,0 +1,151 @@
+package ldap
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"gopkg.in/asn1-ber.v1"
+	"gopkg.in/ldap.v2"
+)
+
+// The ldap library doesn't support extended operations other than StartTLS
+// and password modify, so the "Who am I?" operation of RFC 4532 is written
+// directly to the network connection after a raw bind, before the connection
+// is handed off to the library.
+
+const whoAmIOID = "1.3.6.1.4.1.4203.1.11.3"
+
+// Tags of the extended request and response fields, see RFC 4511 section
+// 4.12.
+const (
+	extendedRequestName   = 0
+	extendedResponseValue = 11
+)
+
+// whoAmI returns the authorization identity the connection is bound as, such
+// as "dn:uid=jane,ou=people,dc=example,dc=com" or "u:EXAMPLE\jane". It's
+// empty for anonymous connections.
+func whoAmI(conn net.Conn) (string, error) {
+	req := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationExtendedRequest, nil, "Extended Request")
+	req.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, extendedRequestName, whoAmIOID, "Who Am I"))
+
+	resp, err := rawRequest(conn, req)
+	if err != nil {
+		return "", err
+	}
+	op := resp.Children[1]
+	if op.Tag != ldap.ApplicationExtendedResponse {
+		return "", ldap.NewError(ldap.ErrorUnexpectedResponse, fmt.Errorf("ldap: expected extended response got tag %d", op.Tag))
+	}
+	if err := rawResultCode(resp); err != nil {
+		return "", err
+	}
+	for _, child := range op.Children[3:] {
+		if child.ClassType == ber.ClassContext && child.Tag == extendedResponseValue {
+			return string(child.Data.Bytes()), nil
+		}
+	}
+	return "", nil
+}
+
+// checkBindIdentity asks the server which identity the connection is bound
+// as and logs it. If dn is set and the server reports a DN, it must be the
+// same entry, to catch binds the server maps to another identity. Identities
+// in other forms, such as Active Directory's "u:DOMAIN\user", are only
+// logged.
+func (c *ldapConnector) checkBindIdentity(ctx context.Context, conn net.Conn, dn string) error {
+	authzID, err := whoAmI(conn)
+	if err != nil {
+		// Not wrapped, so the result code isn't mistaken for the bind's.
+		return fmt.Errorf("ldap: who am I: %v", err)
+	}
+	c.logf(ctx, "ldap: bound as %q, server reports authorization identity %q", dn, authzID)
+	if dn == "" || !strings.HasPrefix(authzID, "dn:") {
+		return nil
+	}
+	if !sameDN(dn, strings.TrimPrefix(authzID, "dn:")) {
+		return fmt.Errorf("ldap: bound as %q but the server reports authorization identity %q", dn, authzID)
+	}
+	return nil
+}
+
+// sameDN reports if two DNs name the same entry. Attribute types and values
+// are compared case insensitively.
+func sameDN(a, b string) bool {
+	dnA, err := ldap.ParseDN(a)
+	if err != nil {
+		return false
+	}
+	dnB, err := ldap.ParseDN(b)
+	if err != nil {
+		return false
+	}
+	return len(dnA.RDNs) == len(dnB.RDNs) && dnUnder(dnA, dnB)
+}
+
+// WhoAmI binds as the service account on a new connection and returns the
+// authorization identity the server reports for it, for health checks that
+// confirm the bind works and maps to the expected account.
+func (c *ldapConnector) WhoAmI(ctx context.Context) (string, error) {
+	var authzID string
+	conn, err := c.connectRaw(ctx, func(conn net.Conn) error {
+		if err := c.serviceBindRaw(conn); err != nil {
+			return err
+		}
+		var err error
+		if authzID, err = whoAmI(conn); err != nil {
+			return fmt.Errorf("ldap: who am I: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	conn.Close()
+	return authzID, nil
+}
+
+// serviceBindDN returns the DN the service account binds as, or an empty
+// string if it binds anonymously or without a DN.
+func (c *ldapConnector) serviceBindDN() string {
+	if c.AnonymousBind || c.BindMode == bindModeExternal || c.BindMode == bindModeNTLM {
+		return ""
+	}
+	return c.BindDN
+}
+
+// serviceBindRaw binds the network connection as the service account, as
+// connect would after handing it off to the ldap library.
+func (c *ldapConnector) serviceBindRaw(conn net.Conn) error {
+	switch {
+	case c.BindMode == bindModeExternal:
+		start := time.Now()
+		err := saslExternalBind(conn)
+		c.observe(OpBind, start, err, FailureAuth)
+		if err != nil {
+			return wrapKind(ErrServiceBind, err, "SASL EXTERNAL")
+		}
+	case c.BindMode == bindModeNTLM:
+		if err := c.bindNTLM(conn, c.BindDN, c.BindPW); err != nil {
+			return wrapKind(ErrServiceBind, err, fmt.Sprintf("NTLM as %q", c.BindDN))
+		}
+	case c.AnonymousBind:
+		start := time.Now()
+		_, err := rawSimpleBind(conn, "", "")
+		c.observe(OpBind, start, err, FailureAuth)
+		if err != nil {
+			return wrapKind(ErrServiceBind, err, "anonymous")
+		}
+	default:
+		start := time.Now()
+		_, err := rawSimpleBind(conn, c.BindDN, c.BindPW)
+		c.observe(OpBind, start, err, FailureAuth)
+		if err != nil {
+			return wrapKind(ErrServiceBind, err, fmt.Sprintf("as %q", c.BindDN))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package ldap
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+	"gopkg.in/asn1-ber.v1"
+	"gopkg.in/ldap.v2"
+
+	"github.com/coreos/dex/connector"
+)
+
+// fakeWhoAmIResponse returns an extended response carrying authzID, or no
+// response value if authzID is empty.
+func fakeWhoAmIResponse(authzID string) *ber.Packet {
+	op := fakeResult(ldap.ApplicationExtendedResponse, ldap.LDAPResultSuccess)
+	if authzID != "" {
+		op.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, extendedResponseValue, authzID, "Response Value"))
+	}
+	return op
+}
+
+// serveWhoAmI answers binds, "Who am I?" requests with the identity authzID
+// maps the bound DN to, and user searches for any username.
+func serveWhoAmI(conn net.Conn, authzID func(boundDN string) string) {
+	defer conn.Close()
+	var boundDN string
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		req := packet.Children[1]
+		var ops []*ber.Packet
+		switch req.Tag {
+		case ldap.ApplicationBindRequest:
+			boundDN, _ = req.Children[1].Value.(string)
+			ops = []*ber.Packet{fakeResult(ldap.ApplicationBindResponse, ldap.LDAPResultSuccess)}
+		case ldap.ApplicationExtendedRequest:
+			ops = []*ber.Packet{fakeWhoAmIResponse(authzID(boundDN))}
+		case ldap.ApplicationSearchRequest:
+			filter, _ := ldap.DecompileFilter(req.Children[6])
+			uid := strings.TrimSuffix(strings.TrimPrefix(filter, "(uid="), ")")
+			ops = []*ber.Packet{
+				fakeEntry("uid="+uid+",ou=people,dc=example,dc=com", map[string][]string{"uid": {uid}, "mail": {uid + "@example.com"}}),
+				fakeResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess),
+			}
+		default:
+			return
+		}
+		for _, op := range ops {
+			resp := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+			resp.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, packet.Children[0].Value, "MessageID"))
+			resp.AppendChild(op)
+			if _, err := conn.Write(resp.Bytes()); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func TestWhoAmI(t *testing.T) {
+	for _, want := range []string{"dn:uid=jane,ou=people,dc=example,dc=com", ""} {
+		client, server := net.Pipe()
+		go serveWhoAmI(server, func(string) string { return want })
+		got, err := whoAmI(client)
+		client.Close()
+		if err != nil {
+			t.Errorf("%q: %v", want, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("want authorization identity %q, got %q", want, got)
+		}
+	}
+}
+
+func TestVerifyBindIdentity(t *testing.T) {
+	authzID := func(boundDN string) string {
+		switch boundDN {
+		case "cn=dex,dc=example,dc=com":
+			// The server may spell the DN differently.
+			return "dn:CN=dex,DC=example,DC=com"
+		case "uid=jane,ou=people,dc=example,dc=com":
+			// A proxy mapping jane to another account.
+			return "dn:uid=admin,ou=people,dc=example,dc=com"
+		case "cn=proxy,dc=example,dc=com":
+			return "dn:cn=root,dc=example,dc=com"
+		case "uid=ad,ou=people,dc=example,dc=com":
+			return `u:EXAMPLE\ad`
+		}
+		return "dn:" + boundDN
+	}
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		client, server := net.Pipe()
+		go serveWhoAmI(server, authzID)
+		return client, nil
+	}
+
+	c := testConfig()
+	c.Host = "ldap.invalid:389"
+	c.InsecureNoSSL = true
+	c.AnonymousBind = false
+	c.BindDN = "cn=dex,dc=example,dc=com"
+	c.BindPW = "secret"
+	c.UserSearch.IDAttr = "uid"
+	c.UserSearch.EmailAttr = "mail"
+	c.VerifyBindIdentity = true
+	conn, err := c.OpenConnector(WithDialFunc(dial))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lc := conn.(*ldapConnector)
+
+	if got, err := lc.WhoAmI(context.Background()); err != nil || got != "dn:CN=dex,DC=example,DC=com" {
+		t.Errorf("expected service account identity, got %q err=%v", got, err)
+	}
+	for _, username := range []string{"john", "ad"} {
+		if _, valid, err := conn.Login(context.Background(), connector.Scopes{}, username, "password"); err != nil || !valid {
+			t.Errorf("%s: expected valid login, got valid=%t err=%v", username, valid, err)
+		}
+	}
+	if _, _, err := conn.Login(context.Background(), connector.Scopes{}, "jane", "password"); err == nil || !strings.Contains(err.Error(), "uid=admin") {
+		t.Errorf("expected login mapped to another identity to fail, got %v", err)
+	}
+
+	c.BindDN = "cn=proxy,dc=example,dc=com"
+	if conn, err = c.OpenConnector(WithDialFunc(dial)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := conn.Login(context.Background(), connector.Scopes{}, "john", "password"); !errors.Is(err, ErrServiceBind) {
+		t.Errorf("expected service bind mapped to another identity to fail, got %v", err)
+	}
+}